@@ -1,12 +1,38 @@
 package main
 
 import (
+	"sync"
+	"time"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
 	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/events"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/mailer"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/oidc"
 )
 
 type apiConfig struct {
 	fileserverHits int
 	db             *database.DB
-	jwtSecret      string
+	jwtKeys        *auth.KeySet
+	authenticator  *auth.Authenticator
 	polkaApiKey    string
+	adminApiKey    string
+	baseURL        string
+	impressions    *impressionCounter
+	trending       *trendingCache
+	events         *events.Hub
+	mailer         mailer.Mailer
+	loginLimiter   *auth.LoginLimiter
+	passwords      *auth.PasswordHasher
+	// encrypts TOTP secrets stored in the database
+	totpSecrets *auth.SecretBox
+	// external login provider, nil unless configured
+	oidc *oidc.Provider
+	// how long a deleted account can still be restored by logging in
+	deletionGracePeriod time.Duration
+	// actions denied to users who haven't verified their email
+	unverifiedRestrictions []string
+	// open websocket connections, waited on during shutdown
+	websockets *sync.WaitGroup
 }
@@ -4,11 +4,10 @@ go 1.21.6
 
 require (
 	github.com/go-chi/chi/v5 v5.0.12
+	github.com/golang-jwt/jwt/v5 v5.2.0
+	github.com/joho/godotenv v1.5.1
+	golang.org/x/crypto v0.20.0
 	golang.org/x/exp v0.0.0-20240213143201-ec583247a57a
 )
 
-require (
-	github.com/golang-jwt/jwt/v5 v5.2.0 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
-	golang.org/x/crypto v0.20.0 // indirect
-)
+require golang.org/x/sys v0.17.0 // indirect
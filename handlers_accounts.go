@@ -0,0 +1,210 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+)
+
+const defaultDeletionGracePeriod = 7 * 24 * time.Hour
+const accountPurgeInterval = time.Hour
+
+func (cfg *apiConfig) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	type requestParameters struct {
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	user, err := cfg.db.GetUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to find user")
+		return
+	}
+
+	if !cfg.reauthenticate(w, r, user, params.Password) {
+		return
+	}
+
+	user, err = cfg.db.ScheduleUserDeletion(userId, time.Now().Add(cfg.deletionGracePeriod))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to delete account")
+		return
+	}
+
+	// logging in again before this time cancels the deletion
+	response := struct {
+		DeletionScheduledAt time.Time `json:"deletion_scheduled_at"`
+	}{
+		DeletionScheduledAt: user.DeletionScheduledAt,
+	}
+	respondWithJSON(w, http.StatusAccepted, response)
+}
+
+func (cfg *apiConfig) exportAccount(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	data, err := cfg.db.ExportUserData(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to export account")
+		return
+	}
+
+	// everything but the password hash and two-factor secrets, which are
+	// credentials rather than personal data
+	user := struct {
+		Id                  int       `json:"id"`
+		Email               string    `json:"email"`
+		EmailVerified       bool      `json:"email_verified"`
+		IsRed               bool      `json:"is_chirpy_red"`
+		Handle              string    `json:"handle"`
+		DisplayName         string    `json:"display_name"`
+		Bio                 string    `json:"bio"`
+		AvatarPath          string    `json:"avatar_path"`
+		DeletionScheduledAt time.Time `json:"deletion_scheduled_at"`
+		TwoFactorEnabled    bool      `json:"two_factor_enabled"`
+	}{
+		Id:                  data.User.Id,
+		Email:               data.User.Email,
+		EmailVerified:       data.User.EmailVerified,
+		IsRed:               data.User.IsRed,
+		Handle:              data.User.Handle,
+		DisplayName:         data.User.DisplayName,
+		Bio:                 data.User.Bio,
+		AvatarPath:          data.User.AvatarPath,
+		DeletionScheduledAt: data.User.DeletionScheduledAt,
+		TwoFactorEnabled:    data.User.TOTPEnabled,
+	}
+
+	// token hashes are left out too
+	personalTokens := []PersonalToken{}
+	for _, token := range data.PersonalTokens {
+		personalTokens = append(personalTokens, newPersonalTokenResponse(token))
+	}
+	// and client secret hashes
+	oauthClients := []OAuthClient{}
+	for _, client := range data.OAuthClients {
+		oauthClients = append(oauthClients, newOAuthClientResponse(client))
+	}
+
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"user.json", user},
+		{"chirps.json", data.Chirps},
+		{"polls.json", data.Polls},
+		{"poll_votes.json", data.PollVotes},
+		{"reactions.json", data.Reactions},
+		{"impressions.json", data.Impressions},
+		{"notifications.json", data.Notifications},
+		{"notification_settings.json", data.NotificationSettings},
+		{"conversations.json", data.Conversations},
+		{"messages.json", data.Messages},
+		{"blocked_users.json", data.BlockedIds},
+		{"muted_users.json", data.MutedIds},
+		{"sessions.json", data.Sessions},
+		{"personal_tokens.json", personalTokens},
+		{"linked_accounts.json", data.ExternalIdentities},
+		{"oauth_clients.json", oauthClients},
+	}
+
+	// exports are small, building the archive first means a failure is a 500
+	// rather than a truncated download
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+	for _, file := range files {
+		dat, err := json.MarshalIndent(file.content, "", "  ")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Unable to export account")
+			return
+		}
+		err = addToArchive(archive, file.name, dat)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Unable to export account")
+			return
+		}
+	}
+
+	if data.User.AvatarPath != "" {
+		dat, err := os.ReadFile(filepath.Join(filepathRoot, data.User.AvatarPath))
+		// an avatar that went missing is left out rather than failing the export
+		if err == nil {
+			err = addToArchive(archive, "avatar"+filepath.Ext(data.User.AvatarPath), dat)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Unable to export account")
+				return
+			}
+		}
+	}
+
+	err = archive.Close()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to export account")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chirpy-export-%d.zip"`, userId))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+func addToArchive(archive *zip.Writer, name string, dat []byte) error {
+	entry, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = entry.Write(dat)
+	return err
+}
+
+// purgeDeletedAccounts removes accounts whose grace period has ended until done is closed
+func (cfg *apiConfig) purgeDeletedAccounts(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := cfg.db.PurgeDeletedUsers(time.Now())
+		if err != nil {
+			fmt.Println("Unable to purge deleted accounts:", err)
+		}
+		for _, user := range purged {
+			if user.AvatarPath != "" {
+				os.Remove(filepath.Join(filepathRoot, user.AvatarPath))
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// cancelAccountDeletion is called on login, signing back in during the grace period keeps the account
+func (cfg *apiConfig) cancelAccountDeletion(user database.User) error {
+	if user.DeletionScheduledAt == (time.Time{}) {
+		return nil
+	}
+	_, err := cfg.db.CancelUserDeletion(user.Id)
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+	"golang.org/x/exp/slices"
+)
+
+const defaultAnalyticsDays = 30
+const maxAnalyticsDays = 365
+
+func (cfg *apiConfig) getAuthorAnalytics(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	// analytics are a chirpy red perk
+	user, err := cfg.db.GetUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to find user")
+		return
+	}
+	if !user.IsRed {
+		respondWithError(w, http.StatusForbidden, "Analytics require Chirpy Red")
+		return
+	}
+
+	numDays := defaultAnalyticsDays
+	if days := r.URL.Query().Get("days"); days != "" {
+		numDays, err = strconv.Atoi(days)
+		if err != nil || numDays < 1 || numDays > maxAnalyticsDays {
+			respondWithError(w, http.StatusBadRequest, "Invalid number of days")
+			return
+		}
+	}
+
+	chirps, err := cfg.db.GetChirps()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting Chirps")
+		return
+	}
+
+	chirpIds := []int{}
+	for _, chirp := range chirps {
+		if chirp.AuthorId == userId {
+			chirpIds = append(chirpIds, chirp.Id)
+		}
+	}
+
+	// replies to the author's chirps, by day they were posted
+	replies := map[int][]database.Chirp{}
+	for _, chirp := range chirps {
+		if chirp.ReplyToId != 0 {
+			replies[chirp.ReplyToId] = append(replies[chirp.ReplyToId], chirp)
+		}
+	}
+
+	impressions, err := cfg.db.GetImpressions(chirpIds)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting impressions")
+		return
+	}
+
+	reactions, err := cfg.db.GetReactions(chirpIds)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting reactions")
+		return
+	}
+
+	type dailyStats struct {
+		Date        string `json:"date"`
+		Impressions int    `json:"impressions"`
+		Reactions   int    `json:"reactions"`
+		Replies     int    `json:"replies"`
+	}
+	type chirpStats struct {
+		ChirpId     int `json:"chirp_id"`
+		Impressions int `json:"impressions"`
+		Reactions   int `json:"reactions"`
+		Replies     int `json:"replies"`
+	}
+
+	// build one entry per day, oldest first, so gaps show up as zero
+	days := make([]dailyStats, numDays)
+	dayIndex := map[string]int{}
+	today := time.Now().UTC()
+	for i := range days {
+		date := database.ImpressionDay(today.AddDate(0, 0, i-numDays+1))
+		days[i] = dailyStats{Date: date}
+		dayIndex[date] = i
+	}
+
+	perChirp := []chirpStats{}
+	for _, chirpId := range chirpIds {
+		stats := chirpStats{ChirpId: chirpId}
+		for date, count := range impressions[chirpId] {
+			i, ok := dayIndex[date]
+			if !ok {
+				continue
+			}
+			days[i].Impressions += count
+			stats.Impressions += count
+		}
+		for _, reaction := range reactions[chirpId] {
+			i, ok := dayIndex[database.ImpressionDay(reaction.CreatedAt)]
+			if !ok {
+				continue
+			}
+			days[i].Reactions++
+			stats.Reactions++
+		}
+		for _, reply := range replies[chirpId] {
+			i, ok := dayIndex[database.ImpressionDay(reply.CreatedAt)]
+			if !ok {
+				continue
+			}
+			days[i].Replies++
+			stats.Replies++
+		}
+		perChirp = append(perChirp, stats)
+	}
+
+	slices.SortFunc(perChirp, func(a, b chirpStats) int {
+		return cmp.Compare(a.ChirpId, b.ChirpId)
+	})
+
+	response := struct {
+		Days   []dailyStats `json:"days"`
+		Chirps []chirpStats `json:"chirps"`
+	}{
+		Days:   days,
+		Chirps: perChirp,
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
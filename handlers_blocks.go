@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+)
+
+func (cfg *apiConfig) blockUser(w http.ResponseWriter, r *http.Request) {
+	cfg.updateRelation(w, r, "blocked", true, cfg.db.BlockUser)
+}
+
+func (cfg *apiConfig) unblockUser(w http.ResponseWriter, r *http.Request) {
+	cfg.updateRelation(w, r, "blocked", false, cfg.db.UnblockUser)
+}
+
+func (cfg *apiConfig) muteUser(w http.ResponseWriter, r *http.Request) {
+	cfg.updateRelation(w, r, "muted", true, cfg.db.MuteUser)
+}
+
+func (cfg *apiConfig) unmuteUser(w http.ResponseWriter, r *http.Request) {
+	cfg.updateRelation(w, r, "muted", false, cfg.db.UnmuteUser)
+}
+
+// updateRelation applies a block or mute change from the caller to the user in the url
+func (cfg *apiConfig) updateRelation(w http.ResponseWriter, r *http.Request, relation string, enabled bool, apply func(userId int, targetId int) error) {
+	userId := currentUserId(r)
+
+	targetId, err := strconv.Atoi(chi.URLParam(r, "userId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "unknown user id")
+		return
+	}
+	if targetId == userId {
+		respondWithError(w, http.StatusBadRequest, "You can't do this to yourself")
+		return
+	}
+
+	err = apply(userId, targetId)
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			respondWithError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to update user")
+		return
+	}
+
+	response := map[string]interface{}{
+		"user_id": targetId,
+		relation:  enabled,
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) getBlockedUsers(w http.ResponseWriter, r *http.Request) {
+	cfg.listRelation(w, r, cfg.db.GetBlockedIds)
+}
+
+func (cfg *apiConfig) getMutedUsers(w http.ResponseWriter, r *http.Request) {
+	cfg.listRelation(w, r, cfg.db.GetMutedIds)
+}
+
+func (cfg *apiConfig) listRelation(w http.ResponseWriter, r *http.Request, list func(userId int) ([]int, error)) {
+	userId := currentUserId(r)
+
+	userIds, err := list(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting users")
+		return
+	}
+
+	response := struct {
+		UserIds []int `json:"user_ids"`
+	}{
+		UserIds: userIds,
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
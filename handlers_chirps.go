@@ -3,6 +3,7 @@ package main
 import (
 	"cmp"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -11,51 +12,60 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
 	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/events"
 	"golang.org/x/exp/slices"
 )
 
-func (cfg *apiConfig) createChirp(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.ParseBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Invalid token")
-		return
-	}
+// chirps are returned with a compact profile of their author
+type Chirp struct {
+	database.Chirp
+	Author Author `json:"author"`
+}
 
-	_, claims, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
-		return
+// withAuthors attaches author profiles to chirps, looking each author up once
+func (cfg *apiConfig) withAuthors(chirps []database.Chirp) ([]Chirp, error) {
+	authorIds := []int{}
+	for _, chirp := range chirps {
+		authorIds = append(authorIds, chirp.AuthorId)
 	}
 
-	issuer, err := claims.GetIssuer()
+	authors, err := cfg.db.GetUsersById(authorIds)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to parse token")
-		return
+		return nil, err
 	}
 
-	if issuer != "chirpy-access" {
-		respondWithError(w, http.StatusUnauthorized, "Non-access token received.")
-		return
-	}
-	// convert id from string to int
-	userId, err := claims.GetSubject()
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to parse user Id")
-		return
+	response := make([]Chirp, 0, len(chirps))
+	for _, chirp := range chirps {
+		author, ok := authors[chirp.AuthorId]
+		if !ok {
+			author = database.User{Id: chirp.AuthorId}
+		}
+		response = append(response, Chirp{
+			Chirp:  chirp,
+			Author: cfg.newAuthorResponse(author),
+		})
 	}
-	userIdNum, err := strconv.Atoi(userId)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to parse user Id")
+
+	return response, nil
+}
+
+func (cfg *apiConfig) createChirp(w http.ResponseWriter, r *http.Request) {
+	userIdNum := currentUserId(r)
+
+	if !cfg.requireVerified(w, userIdNum, restrictChirps) {
 		return
 	}
 
 	type parameters struct {
-		Body string `json:"body"`
+		Body string          `json:"body"`
+		Poll *pollParameters `json:"poll"`
+		// optional, the chirp this one replies to
+		ReplyToId int `json:"reply_to_id"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
+	err := decoder.Decode(&params)
 
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Something went wrong")
@@ -69,16 +79,71 @@ func (cfg *apiConfig) createChirp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if params.Poll != nil {
+		err = params.Poll.validate()
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// a blocked user can't reply to the blocker's chirps
+	if params.ReplyToId != 0 {
+		parent, err := cfg.db.GetChirp(params.ReplyToId)
+		if err != nil {
+			respondWithError(w, http.StatusNotFound, "The chirp you replied to doesn't exist")
+			return
+		}
+		blocked, err := cfg.db.IsBlockedBy(userIdNum, parent.AuthorId)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error creating Chirp")
+			return
+		}
+		if blocked {
+			respondWithError(w, http.StatusForbidden, "You can't reply to this chirp")
+			return
+		}
+	}
+
 	cleanedMessage := cleanseProfanity(params.Body)
 
-	chirp, err := cfg.db.CreateChirp(cleanedMessage, userIdNum)
+	var chirp database.Chirp
+	if params.Poll != nil {
+		chirp, _, err = cfg.db.CreateChirpWithPoll(cleanedMessage, userIdNum, params.ReplyToId, params.Poll.Options, params.Poll.ClosesAt)
+	} else {
+		chirp, err = cfg.db.CreateChirp(cleanedMessage, userIdNum, params.ReplyToId)
+	}
+	if err != nil {
+		if errors.Is(err, database.ErrChirpNotFound) {
+			respondWithError(w, http.StatusNotFound, "The chirp you replied to doesn't exist")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Error creating Chirp")
+		return
+	}
+
+	if chirp.ReplyToId != 0 {
+		parent, err := cfg.db.GetChirp(chirp.ReplyToId)
+		if err == nil {
+			cfg.notify(parent.AuthorId, database.NotificationReply, chirp.AuthorId, chirp.Id)
+		}
+	}
+	for _, handle := range extractMentions(chirp.Body) {
+		mentioned, err := cfg.db.GetUserByHandle(handle)
+		if err == nil {
+			cfg.notify(mentioned.Id, database.NotificationMention, chirp.AuthorId, chirp.Id)
+		}
+	}
 
+	response, err := cfg.withAuthors([]database.Chirp{chirp})
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error creating Chirp")
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, chirp)
+	cfg.events.Publish(events.ChirpCreated, chirp.AuthorId, response[0])
+
+	respondWithJSON(w, http.StatusCreated, response[0])
 }
 
 func cleanseProfanity(msg string) (cleansedMsg string) {
@@ -96,6 +161,17 @@ func cleanseProfanity(msg string) (cleansedMsg string) {
 }
 
 func (cfg *apiConfig) getChirps(w http.ResponseWriter, r *http.Request) {
+	// authentication is optional, signed in users don't see chirps from users they muted
+	mutedIds := []int{}
+	if principal, ok := auth.PrincipalFromContext(r.Context()); ok {
+		var err error
+		mutedIds, err = cfg.db.GetMutedIds(principal.UserId)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error getting Chirps")
+			return
+		}
+	}
+
 	Chirps, err := cfg.db.GetChirps()
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error getting Chirps")
@@ -106,15 +182,17 @@ func (cfg *apiConfig) getChirps(w http.ResponseWriter, r *http.Request) {
 	author_id := r.URL.Query().Get("author_id")
 	id, err := strconv.Atoi(author_id)
 
+	filterByAuthor := err == nil
+
 	filteredChirps := []database.Chirp{}
-	if err == nil {
-		for _, chirp := range Chirps {
-			if chirp.AuthorId == id {
-				filteredChirps = append(filteredChirps, chirp)
-			}
+	for _, chirp := range Chirps {
+		if filterByAuthor && chirp.AuthorId != id {
+			continue
 		}
-	} else {
-		filteredChirps = Chirps
+		if slices.Contains(mutedIds, chirp.AuthorId) {
+			continue
+		}
+		filteredChirps = append(filteredChirps, chirp)
 	}
 
 	sortOrder := r.URL.Query().Get("sort")
@@ -130,7 +208,15 @@ func (cfg *apiConfig) getChirps(w http.ResponseWriter, r *http.Request) {
 	if sortOrder == "desc" {
 		slices.Reverse(filteredChirps)
 	}
-	respondWithJSON(w, http.StatusOK, filteredChirps)
+
+	response, err := cfg.withAuthors(filteredChirps)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting Chirps")
+		return
+	}
+
+	cfg.impressions.record(filteredChirps...)
+	respondWithJSON(w, http.StatusOK, response)
 }
 
 func (cfg *apiConfig) getChirpById(w http.ResponseWriter, r *http.Request) {
@@ -146,43 +232,18 @@ func (cfg *apiConfig) getChirpById(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, Chirp)
-}
-
-func (cfg *apiConfig) deleteChirp(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.ParseBearerToken(r.Header)
+	response, err := cfg.withAuthors([]database.Chirp{Chirp})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Invalid token")
+		respondWithError(w, http.StatusInternalServerError, "Error getting Chirp")
 		return
 	}
 
-	_, claims, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
-		return
-	}
-
-	issuer, err := claims.GetIssuer()
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to parse token")
-		return
-	}
+	cfg.impressions.record(Chirp)
+	respondWithJSON(w, http.StatusOK, response[0])
+}
 
-	if issuer != "chirpy-access" {
-		respondWithError(w, http.StatusUnauthorized, "Non-access token received.")
-		return
-	}
-	// convert id from string to int
-	userId, err := claims.GetSubject()
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to parse user Id")
-		return
-	}
-	userIdNum, err := strconv.Atoi(userId)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to parse user Id")
-		return
-	}
+func (cfg *apiConfig) deleteChirp(w http.ResponseWriter, r *http.Request) {
+	userIdNum := currentUserId(r)
 
 	chirpId, err := strconv.Atoi(chi.URLParam(r, "chirpId"))
 	if err != nil {
@@ -205,5 +266,14 @@ func (cfg *apiConfig) deleteChirp(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusInternalServerError, "Unable to delete chirp")
 		return
 	}
+
+	deleted := struct {
+		Id       int `json:"id"`
+		AuthorId int `json:"author_id"`
+	}{
+		Id:       Chirp.Id,
+		AuthorId: Chirp.AuthorId,
+	}
+	cfg.events.Publish(events.ChirpDeleted, Chirp.AuthorId, deleted)
 	respondWithJSON(w, http.StatusOK, "chirp deleted")
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+)
+
+// Browsers can ask for a cookie session by sending this header with a login
+// request. The refresh token then goes in an HttpOnly cookie that scripts
+// can't read, and only the short-lived access token is returned.
+const sessionModeHeader = "X-Session-Mode"
+
+const (
+	refreshCookieName = "chirpy_refresh"
+	// readable by scripts, which echo it in the CSRF header
+	csrfCookieName = "chirpy_csrf"
+	csrfHeader     = "X-CSRF-Token"
+)
+
+// the refresh cookie is only sent to the cookie session endpoints
+const cookieSessionPath = "/api/session"
+
+func wantsCookieSession(r *http.Request) bool {
+	return r.Header.Get(sessionModeHeader) == "cookie"
+}
+
+// setSessionCookies stores the refresh token and a fresh CSRF token in
+// cookies, returning the CSRF token for the response body
+func setSessionCookies(w http.ResponseWriter, refreshToken string) (string, error) {
+	csrfToken, _, err := auth.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	maxAge := int(refreshTokenLifetime.Seconds())
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    refreshToken,
+		Path:     cookieSessionPath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrfToken,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return csrfToken, nil
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, cookie := range []*http.Cookie{
+		{Name: refreshCookieName, Path: cookieSessionPath, HttpOnly: true},
+		{Name: csrfCookieName, Path: "/"},
+	} {
+		cookie.MaxAge = -1
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteStrictMode
+		http.SetCookie(w, cookie)
+	}
+}
+
+// middlewareCSRF rejects state-changing requests unless the CSRF header
+// matches the CSRF cookie. Another site can make the browser send cookies,
+// but can't read them to fill in the header.
+func middlewareCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(csrfCookieName)
+		header := r.Header.Get(csrfHeader)
+		if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+			respondWithError(w, http.StatusForbidden, "Missing or invalid CSRF token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// refreshCookieSession is /api/refresh for cookie sessions, the new refresh
+// token replaces the old one in the cookie
+func (cfg *apiConfig) refreshCookieSession(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(refreshCookieName)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	accessToken, newRefreshToken, ok := cfg.rotateRefreshToken(w, r, cookie.Value)
+	if !ok {
+		return
+	}
+
+	csrfToken, err := setSessionCookies(w, newRefreshToken)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to issue refresh token")
+		return
+	}
+
+	response := struct {
+		Token     string `json:"token"`
+		CSRFToken string `json:"csrf_token"`
+	}{
+		Token:     accessToken,
+		CSRFToken: csrfToken,
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// logoutCookieSession revokes the cookie session and clears its cookies.
+// Signing out is never refused, even if the session is already gone.
+func (cfg *apiConfig) logoutCookieSession(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(refreshCookieName)
+	if err == nil {
+		_, claims, err := auth.ValidateJWT(cookie.Value, cfg.jwtKeys)
+		if err == nil && claims.Issuer == "chirpy-refresh" {
+			err = cfg.db.RevokeToken(auth.HashToken(cookie.Value))
+			if err != nil && !errors.Is(err, database.ErrTokenNotFound) {
+				respondWithError(w, http.StatusInternalServerError, "Unable to revoke session")
+				return
+			}
+		}
+	}
+
+	clearSessionCookies(w)
+	respondWithJSON(w, http.StatusOK, "")
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+	"golang.org/x/exp/slices"
+)
+
+// number of most recent chirps included in a feed
+const feedSize = 50
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Id        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published"`
+	Link      atomLink   `xml:"link"`
+	Author    atomAuthor `xml:"author"`
+	Content   atomText   `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	PubDate     string  `xml:"pubDate"`
+	Guid        rssGuid `xml:"guid"`
+}
+
+type rssGuid struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Id          string `xml:",chardata"`
+}
+
+// feed is the format independent description of a feed
+type feed struct {
+	title   string
+	link    string
+	chirps  []database.Chirp
+	authors map[int]database.User
+	// when any chirp was last deleted
+	deletedAt time.Time
+}
+
+// authorName picks the friendliest name a user has set
+func authorName(user database.User) string {
+	if user.DisplayName != "" {
+		return user.DisplayName
+	}
+	if user.Handle != "" {
+		return "@" + user.Handle
+	}
+	return fmt.Sprintf("user %d", user.Id)
+}
+
+func (cfg *apiConfig) chirpURL(chirpId int) string {
+	return fmt.Sprintf("%s/api/chirps/%d", cfg.baseURL, chirpId)
+}
+
+// updated is the creation time of the newest chirp in the feed, or the last
+// deletion if that came later since it may have removed a chirp from the feed
+func (f feed) updated() time.Time {
+	updated := time.Unix(0, 0).UTC()
+	if f.deletedAt.After(updated) {
+		updated = f.deletedAt
+	}
+	for _, chirp := range f.chirps {
+		if chirp.CreatedAt.After(updated) {
+			updated = chirp.CreatedAt
+		}
+	}
+	return updated
+}
+
+// etag changes whenever a chirp is added to or removed from the feed
+func (f feed) etag() string {
+	hash := sha256.New()
+	for _, chirp := range f.chirps {
+		fmt.Fprintf(hash, "%d:%d\n", chirp.Id, chirp.CreatedAt.UnixNano())
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil))[:32] + `"`
+}
+
+func chirpTitle(body string) string {
+	const maxTitle = 50
+	runes := []rune(body)
+	if len(runes) <= maxTitle {
+		return body
+	}
+	return strings.TrimSpace(string(runes[:maxTitle])) + "…"
+}
+
+func (cfg *apiConfig) renderAtom(f feed, selfURL string) ([]byte, error) {
+	atom := atomFeed{
+		Id:      selfURL,
+		Title:   f.title,
+		Updated: f.updated().Format(time.RFC3339),
+		Link: []atomLink{
+			{Href: selfURL, Rel: "self"},
+			{Href: f.link, Rel: "alternate"},
+		},
+		Entries: []atomEntry{},
+	}
+	for _, chirp := range f.chirps {
+		url := cfg.chirpURL(chirp.Id)
+		author := f.authors[chirp.AuthorId]
+		author.Id = chirp.AuthorId
+		atom.Entries = append(atom.Entries, atomEntry{
+			Id:        url,
+			Title:     chirpTitle(chirp.Body),
+			Updated:   chirp.CreatedAt.Format(time.RFC3339),
+			Published: chirp.CreatedAt.Format(time.RFC3339),
+			Link:      atomLink{Href: url, Rel: "alternate"},
+			Author:    atomAuthor{Name: authorName(author)},
+			Content:   atomText{Type: "text", Body: chirp.Body},
+		})
+	}
+
+	dat, err := xml.MarshalIndent(atom, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), dat...), nil
+}
+
+func (cfg *apiConfig) renderRSS(f feed) ([]byte, error) {
+	rss := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         f.title,
+			Link:          f.link,
+			Description:   f.title,
+			LastBuildDate: f.updated().Format(time.RFC1123Z),
+			Items:         []rssItem{},
+		},
+	}
+	for _, chirp := range f.chirps {
+		url := cfg.chirpURL(chirp.Id)
+		rss.Channel.Items = append(rss.Channel.Items, rssItem{
+			Title:       chirpTitle(chirp.Body),
+			Link:        url,
+			Description: chirp.Body,
+			PubDate:     chirp.CreatedAt.Format(time.RFC1123Z),
+			Guid:        rssGuid{IsPermaLink: true, Id: url},
+		})
+	}
+
+	dat, err := xml.MarshalIndent(rss, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), dat...), nil
+}
+
+// serveFeed renders the feed in the requested format. ServeContent takes care
+// of If-None-Match and If-Modified-Since so readers polling an unchanged feed
+// get a 304.
+func (cfg *apiConfig) serveFeed(w http.ResponseWriter, r *http.Request, f feed, format string) {
+	// newest first, capped
+	slices.SortFunc(f.chirps, func(a, b database.Chirp) int {
+		return cmp.Compare(b.Id, a.Id)
+	})
+	if len(f.chirps) > feedSize {
+		f.chirps = f.chirps[:feedSize]
+	}
+
+	authorIds := []int{}
+	for _, chirp := range f.chirps {
+		authorIds = append(authorIds, chirp.AuthorId)
+	}
+	authors, err := cfg.db.GetUsersById(authorIds)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error rendering feed")
+		return
+	}
+	f.authors = authors
+
+	f.deletedAt, err = cfg.db.GetChirpsDeletedAt()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error rendering feed")
+		return
+	}
+
+	var dat []byte
+	switch format {
+	case "atom":
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		dat, err = cfg.renderAtom(f, cfg.baseURL+r.URL.Path)
+	case "rss":
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		dat, err = cfg.renderRSS(f)
+	default:
+		respondWithError(w, http.StatusNotFound, "Unknown feed format")
+		return
+	}
+	if err != nil {
+		w.Header().Del("Content-Type")
+		respondWithError(w, http.StatusInternalServerError, "Error rendering feed")
+		return
+	}
+
+	w.Header().Set("ETag", f.etag())
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", f.updated(), bytes.NewReader(dat))
+}
+
+func (cfg *apiConfig) getUserFeed(w http.ResponseWriter, r *http.Request) {
+	userId, err := strconv.Atoi(chi.URLParam(r, "userId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "unknown user id")
+		return
+	}
+
+	user, err := cfg.db.GetUserById(userId)
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			respondWithError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to find user")
+		return
+	}
+
+	chirps, err := cfg.db.GetChirps()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting Chirps")
+		return
+	}
+
+	f := feed{
+		title:  "Chirps by " + authorName(user),
+		link:   fmt.Sprintf("%s/api/chirps?author_id=%d", cfg.baseURL, userId),
+		chirps: []database.Chirp{},
+	}
+	for _, chirp := range chirps {
+		if chirp.AuthorId == userId {
+			f.chirps = append(f.chirps, chirp)
+		}
+	}
+
+	cfg.serveFeed(w, r, f, chi.URLParam(r, "format"))
+}
+
+func (cfg *apiConfig) getHashtagFeed(w http.ResponseWriter, r *http.Request) {
+	tag := strings.ToLower(chi.URLParam(r, "tag"))
+
+	chirps, err := cfg.db.GetChirps()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting Chirps")
+		return
+	}
+
+	f := feed{
+		title:  "Chirps tagged #" + tag,
+		link:   cfg.baseURL + "/app",
+		chirps: []database.Chirp{},
+	}
+	for _, chirp := range chirps {
+		if slices.Contains(extractHashtags(chirp.Body), tag) {
+			f.chirps = append(f.chirps, chirp)
+		}
+	}
+
+	cfg.serveFeed(w, r, f, chi.URLParam(r, "format"))
+}
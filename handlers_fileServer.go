@@ -2,6 +2,18 @@ package main
 
 import "net/http"
 
-const filepathRoot = "."
+// only this directory is served, the database and outbox live outside it
+const filepathRoot = "static"
 
-var fileServerHandler = http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
+var fileServerHandler = middlewareNoFraming(http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot))))
+
+// middlewareNoFraming keeps other sites from showing a page in a frame. The
+// consent and login pages have buttons that mustn't be clicked through an
+// invisible frame.
+func middlewareNoFraming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+		next.ServeHTTP(w, r)
+	})
+}
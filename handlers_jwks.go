@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
+)
+
+// getJWKS publishes the public keys Chirpy tokens are signed with, so other
+// services can verify them without sharing a secret
+func (cfg *apiConfig) getJWKS(w http.ResponseWriter, r *http.Request) {
+	response := struct {
+		Keys []auth.JWK `json:"keys"`
+	}{
+		Keys: cfg.jwtKeys.JWKS(),
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
+)
+
+// requireAdmin checks the ADMIN_API_KEY, admin endpoints are disabled without one
+func (cfg *apiConfig) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if cfg.adminApiKey == "" {
+		respondWithError(w, http.StatusNotFound, "")
+		return false
+	}
+
+	apiKey, err := auth.ParseApiKey(r.Header)
+	if err != nil || apiKey != cfg.adminApiKey {
+		respondWithError(w, http.StatusUnauthorized, "you can't do this")
+		return false
+	}
+
+	return true
+}
+
+func (cfg *apiConfig) getLockouts(w http.ResponseWriter, r *http.Request) {
+	if !cfg.requireAdmin(w, r) {
+		return
+	}
+
+	response := struct {
+		Lockouts []auth.Lockout `json:"lockouts"`
+	}{
+		Lockouts: cfg.loginLimiter.Lockouts(time.Now()),
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) clearLockout(w http.ResponseWriter, r *http.Request) {
+	if !cfg.requireAdmin(w, r) {
+		return
+	}
+
+	// kind is account (keyed by email) or ip
+	kind := r.URL.Query().Get("kind")
+	key := r.URL.Query().Get("key")
+	if (kind != auth.LockoutAccount && kind != auth.LockoutIP) || key == "" {
+		respondWithError(w, http.StatusBadRequest, "Expected kind=account|ip and a key")
+		return
+	}
+
+	if !cfg.loginLimiter.Clear(kind, key) {
+		respondWithError(w, http.StatusNotFound, "No lockout for that key")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, "")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/mailer"
+)
+
+const magicLinkLifetime = 15 * time.Minute
+
+// served by the file server, see login/magic-link.html
+const magicLinkPagePath = "/app/login/magic-link.html"
+
+func (cfg *apiConfig) requestMagicLink(w http.ResponseWriter, r *http.Request) {
+	type requestParameters struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	// like password resets, the response doesn't tell whether the account exists
+	user, err := cfg.db.GetUserByEmail(params.Email)
+	if err == nil {
+		go func() {
+			err := cfg.sendMagicLinkEmail(user)
+			if err != nil {
+				fmt.Println("Unable to send magic link email:", err)
+			}
+		}()
+	} else if !errors.Is(err, database.ErrUserNotFound) {
+		fmt.Println("Unable to look up user for magic link:", err)
+	}
+
+	respondWithJSON(w, http.StatusAccepted, "")
+}
+
+func (cfg *apiConfig) sendMagicLinkEmail(user database.User) error {
+	token, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	// asking again replaces the previous link
+	err = cfg.db.CreateOneTimeToken(user.Id, database.TokenPurposeMagicLink, hash, time.Now().Add(magicLinkLifetime))
+	if err != nil {
+		return err
+	}
+
+	// the token goes in the fragment so it never reaches server logs or
+	// Referer headers, and the page only signs in once it posts the token
+	// back, so link scanners opening the link don't use it up
+	return cfg.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your Chirpy sign in link",
+		Body: fmt.Sprintf(`Someone asked to sign in to your Chirpy account.
+
+To sign in, open this link:
+
+%s%s#token=%s
+
+The link can be used once and expires in 15 minutes. If you didn't ask for this you can ignore this email.
+`, cfg.baseURL, magicLinkPagePath, token),
+	})
+}
+
+// confirmMagicLink exchanges the token from a magic link for the same
+// response as a password login
+func (cfg *apiConfig) confirmMagicLink(w http.ResponseWriter, r *http.Request) {
+	type requestParameters struct {
+		Token string `json:"token"`
+		// optional, shown in the user's list of sessions
+		DeviceName string `json:"device_name"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err := decoder.Decode(&params)
+	if err != nil || params.Token == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	token, err := cfg.db.ConsumeOneTimeToken(auth.HashToken(params.Token), database.TokenPurposeMagicLink)
+	if err != nil {
+		if errors.Is(err, database.ErrOneTimeTokenInvalid) {
+			respondWithError(w, http.StatusUnauthorized, "Invalid or expired link")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to sign in")
+		return
+	}
+
+	// opening the link proves the address belongs to the user
+	user, err := cfg.db.VerifyEmail(token.UserId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to sign in")
+		return
+	}
+
+	cfg.loginAs(w, r, user, params.DeviceName)
+}
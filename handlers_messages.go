@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/events"
+)
+
+// conversations are one-to-one or small groups, counting the creator
+const maxConversationParticipants = 8
+const maxMessageLength = 1000
+
+const defaultMessagesLimit = 50
+const maxMessagesLimit = 100
+
+type Conversation struct {
+	Id           int       `json:"id"`
+	Participants []int     `json:"participants"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	UnreadCount  int       `json:"unread_count"`
+	// id of the last message each participant has read
+	ReadReceipts map[int]int `json:"read_receipts"`
+}
+
+func newConversationResponse(conversation database.Conversation, unreadCount int) Conversation {
+	readReceipts := map[int]int{}
+	for userId, messageId := range conversation.LastRead {
+		readReceipts[userId] = messageId
+	}
+
+	return Conversation{
+		Id:           conversation.Id,
+		Participants: conversation.Participants,
+		CreatedAt:    conversation.CreatedAt,
+		UpdatedAt:    conversation.UpdatedAt,
+		UnreadCount:  unreadCount,
+		ReadReceipts: readReceipts,
+	}
+}
+
+// respondWithConversationError maps conversation lookup errors to responses.
+// Non-participants get a 404 so conversation ids can't be probed.
+func respondWithConversationError(w http.ResponseWriter, err error) {
+	if errors.Is(err, database.ErrConversationNotFound) || errors.Is(err, database.ErrNotParticipant) {
+		respondWithError(w, http.StatusNotFound, "Conversation not found")
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, "Error getting conversation")
+}
+
+func (cfg *apiConfig) createConversation(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	if !cfg.requireVerified(w, userId, restrictMessages) {
+		return
+	}
+
+	type requestParameters struct {
+		ParticipantIds []int `json:"participant_ids"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	participants := []int{userId}
+	for _, participantId := range params.ParticipantIds {
+		if participantId != userId {
+			participants = append(participants, participantId)
+		}
+	}
+	if len(participants) < 2 {
+		respondWithError(w, http.StatusBadRequest, "A conversation needs at least one other participant")
+		return
+	}
+	if len(participants) > maxConversationParticipants {
+		respondWithError(w, http.StatusBadRequest, "Too many participants")
+		return
+	}
+
+	blocked, err := cfg.db.IsBlockedBy(userId, participants...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to create conversation")
+		return
+	}
+	if blocked {
+		respondWithError(w, http.StatusForbidden, "You can't message one of these users")
+		return
+	}
+
+	conversation, err := cfg.db.CreateConversation(participants)
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			respondWithError(w, http.StatusBadRequest, "Unknown participant")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to create conversation")
+		return
+	}
+
+	unread, err := cfg.db.CountUnreadMessages(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to create conversation")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, newConversationResponse(conversation, unread[conversation.Id]))
+}
+
+func (cfg *apiConfig) getConversations(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	conversations, err := cfg.db.GetConversations(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting conversations")
+		return
+	}
+
+	unread, err := cfg.db.CountUnreadMessages(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting conversations")
+		return
+	}
+
+	response := struct {
+		Conversations []Conversation `json:"conversations"`
+		UnreadCount   int            `json:"unread_count"`
+	}{
+		Conversations: []Conversation{},
+	}
+	for _, conversation := range conversations {
+		response.Conversations = append(response.Conversations, newConversationResponse(conversation, unread[conversation.Id]))
+		response.UnreadCount += unread[conversation.Id]
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) getConversation(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	conversationId, err := strconv.Atoi(chi.URLParam(r, "conversationId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "unknown conversation id")
+		return
+	}
+
+	conversation, err := cfg.db.GetConversation(conversationId, userId)
+	if err != nil {
+		respondWithConversationError(w, err)
+		return
+	}
+
+	unread, err := cfg.db.CountUnreadMessages(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting conversation")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newConversationResponse(conversation, unread[conversation.Id]))
+}
+
+func (cfg *apiConfig) getMessages(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	conversationId, err := strconv.Atoi(chi.URLParam(r, "conversationId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "unknown conversation id")
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultMessagesLimit
+	if limitParam := query.Get("limit"); limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 1 || limit > maxMessagesLimit {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+	}
+	beforeId := 0
+	if beforeParam := query.Get("before_id"); beforeParam != "" {
+		beforeId, err = strconv.Atoi(beforeParam)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid before_id")
+			return
+		}
+	}
+
+	_, err = cfg.db.GetConversation(conversationId, userId)
+	if err != nil {
+		respondWithConversationError(w, err)
+		return
+	}
+
+	messages, err := cfg.db.GetMessages(conversationId, beforeId, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting messages")
+		return
+	}
+
+	response := struct {
+		Messages []database.Message `json:"messages"`
+		// pass as before_id to get the next page, absent on the last page
+		NextBeforeId int `json:"next_before_id,omitempty"`
+	}{
+		Messages: messages,
+	}
+	if len(messages) == limit {
+		response.NextBeforeId = messages[len(messages)-1].Id
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) createMessage(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	if !cfg.requireVerified(w, userId, restrictMessages) {
+		return
+	}
+
+	conversationId, err := strconv.Atoi(chi.URLParam(r, "conversationId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "unknown conversation id")
+		return
+	}
+
+	type requestParameters struct {
+		Body string `json:"body"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if strings.TrimSpace(params.Body) == "" {
+		respondWithError(w, http.StatusBadRequest, "Message can't be empty")
+		return
+	}
+	if len(params.Body) > maxMessageLength {
+		respondWithError(w, http.StatusBadRequest, "Message is too long")
+		return
+	}
+
+	conversation, err := cfg.db.GetConversation(conversationId, userId)
+	if err != nil {
+		respondWithConversationError(w, err)
+		return
+	}
+
+	blocked, err := cfg.db.IsBlockedBy(userId, conversation.Participants...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to send message")
+		return
+	}
+	if blocked {
+		respondWithError(w, http.StatusForbidden, "You can't message one of these users")
+		return
+	}
+
+	message, err := cfg.db.CreateMessage(conversationId, userId, params.Body)
+	if err != nil {
+		respondWithConversationError(w, err)
+		return
+	}
+
+	for _, participantId := range conversation.Participants {
+		if participantId != userId {
+			cfg.events.PublishTo(events.MessageCreated, participantId, message)
+		}
+	}
+
+	respondWithJSON(w, http.StatusCreated, message)
+}
+
+func (cfg *apiConfig) markConversationRead(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	conversationId, err := strconv.Atoi(chi.URLParam(r, "conversationId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "unknown conversation id")
+		return
+	}
+
+	// without a message id the whole conversation is marked read
+	type requestParameters struct {
+		MessageId int `json:"message_id"`
+	}
+
+	params := requestParameters{}
+	if r.Body != http.NoBody {
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&params)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+
+	conversation, err := cfg.db.MarkConversationRead(conversationId, userId, params.MessageId)
+	if err != nil {
+		respondWithConversationError(w, err)
+		return
+	}
+
+	unread, err := cfg.db.CountUnreadMessages(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting conversation")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newConversationResponse(conversation, unread[conversation.Id]))
+}
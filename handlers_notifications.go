@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/events"
+	"golang.org/x/exp/slices"
+)
+
+const defaultNotificationsLimit = 20
+const maxNotificationsLimit = 100
+
+type Notification struct {
+	Id        int       `json:"id"`
+	Type      string    `json:"type"`
+	ActorId   int       `json:"actor_id"`
+	ChirpId   int       `json:"chirp_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Read      bool      `json:"read"`
+}
+
+func newNotificationResponse(notification database.Notification) Notification {
+	return Notification{
+		Id:        notification.Id,
+		Type:      notification.Type,
+		ActorId:   notification.ActorId,
+		ChirpId:   notification.ChirpId,
+		CreatedAt: notification.CreatedAt,
+		Read:      notification.IsRead(),
+	}
+}
+
+// notify records a notification for userId and pushes it to their open
+// connections. Failures are logged rather than failing the triggering request.
+func (cfg *apiConfig) notify(userId int, notificationType string, actorId int, chirpId int) {
+	// nobody needs to be told about their own actions
+	if userId == actorId {
+		return
+	}
+
+	// blocked users can't reach the blocker through notifications either
+	blocked, err := cfg.db.IsBlockedBy(actorId, userId)
+	if err != nil || blocked {
+		return
+	}
+
+	notification, err := cfg.db.CreateNotification(userId, notificationType, actorId, chirpId)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotificationMuted) {
+			fmt.Println("Unable to create notification:", err)
+		}
+		return
+	}
+
+	cfg.events.PublishTo(events.NotificationCreated, userId, newNotificationResponse(notification))
+}
+
+func (cfg *apiConfig) getNotifications(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	var err error
+	query := r.URL.Query()
+	limit := defaultNotificationsLimit
+	if limitParam := query.Get("limit"); limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 1 || limit > maxNotificationsLimit {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+	}
+	beforeId := 0
+	if beforeParam := query.Get("before_id"); beforeParam != "" {
+		beforeId, err = strconv.Atoi(beforeParam)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid before_id")
+			return
+		}
+	}
+	unreadOnly := query.Get("unread") == "true"
+
+	notifications, err := cfg.db.GetNotifications(userId, beforeId, limit, unreadOnly)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting notifications")
+		return
+	}
+
+	unreadCount, err := cfg.db.CountUnreadNotifications(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting notifications")
+		return
+	}
+
+	response := struct {
+		Notifications []Notification `json:"notifications"`
+		UnreadCount   int            `json:"unread_count"`
+		// pass as before_id to get the next page, absent on the last page
+		NextBeforeId int `json:"next_before_id,omitempty"`
+	}{
+		Notifications: []Notification{},
+		UnreadCount:   unreadCount,
+	}
+	for _, notification := range notifications {
+		response.Notifications = append(response.Notifications, newNotificationResponse(notification))
+	}
+	if len(notifications) == limit {
+		response.NextBeforeId = notifications[len(notifications)-1].Id
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) markNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	// either a list of ids or all of them
+	type requestParameters struct {
+		Ids []int `json:"ids"`
+		All bool  `json:"all"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err := decoder.Decode(&params)
+	if err != nil || (len(params.Ids) == 0) == !params.All {
+		respondWithError(w, http.StatusBadRequest, "Provide either ids or all")
+		return
+	}
+
+	err = cfg.db.MarkNotificationsRead(userId, params.Ids)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to mark notifications read")
+		return
+	}
+
+	unreadCount, err := cfg.db.CountUnreadNotifications(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting notifications")
+		return
+	}
+
+	response := struct {
+		UnreadCount int `json:"unread_count"`
+	}{
+		UnreadCount: unreadCount,
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) getNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	settings, err := cfg.db.GetNotificationSettings(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting notification settings")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, settings)
+}
+
+func (cfg *apiConfig) updateNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	decoder := json.NewDecoder(r.Body)
+	params := database.NotificationSettings{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	mutedTypes := []string{}
+	for _, notificationType := range params.MutedTypes {
+		if !slices.Contains(database.NotificationTypes, notificationType) {
+			respondWithError(w, http.StatusBadRequest, "Unknown notification type: "+notificationType)
+			return
+		}
+		if !slices.Contains(mutedTypes, notificationType) {
+			mutedTypes = append(mutedTypes, notificationType)
+		}
+	}
+
+	settings, err := cfg.db.UpdateNotificationSettings(userId, database.NotificationSettings{MutedTypes: mutedTypes})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to update notification settings")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, settings)
+}
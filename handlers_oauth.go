@@ -0,0 +1,669 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+	"golang.org/x/exp/slices"
+)
+
+// authorization codes only have to survive the redirect back to the client
+const authorizationCodeLifetime = 5 * time.Minute
+
+// served by the file server, see oauth/consent.html
+const consentPagePath = "/app/oauth/consent.html"
+
+const maxRedirectURIs = 10
+
+type OAuthClient struct {
+	Id           string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func newOAuthClientResponse(client database.OAuthClient) OAuthClient {
+	return OAuthClient{
+		Id:           client.Id,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+		Confidential: client.Confidential(),
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+// oauthError is an error response as defined in RFC 6749 section 5.2
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// respondWithOAuthError sends err if it is an oauthError, anything else is a
+// server_error
+func respondWithOAuthError(w http.ResponseWriter, code int, err error) {
+	oauthErr := oauthError{}
+	if !errors.As(err, &oauthErr) {
+		code = http.StatusInternalServerError
+		oauthErr = oauthError{"server_error", ""}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+	}
+	respondWithJSON(w, code, oauthErr)
+}
+
+// validRedirectURI accepts https URLs, and plain http only on the loopback
+// interface for apps running on the user's machine
+func validRedirectURI(redirectURI string) bool {
+	u, err := url.Parse(redirectURI)
+	if err != nil || !u.IsAbs() || u.Fragment != "" || u.Host == "" {
+		return false
+	}
+
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		return false
+	}
+}
+
+// parseScopes splits a space separated scope parameter. At least one scope
+// is required so apps never get full access.
+func parseScopes(scope string) ([]string, error) {
+	scopes := []string{}
+	for _, s := range strings.Fields(scope) {
+		if !slices.Contains(grantableScopes, s) {
+			return nil, oauthError{"invalid_scope", "unknown scope " + s}
+		}
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, oauthError{"invalid_scope", "at least one scope is required"}
+	}
+	return scopes, nil
+}
+
+func (cfg *apiConfig) createOAuthClient(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	type requestParameters struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		// confidential clients run on a server and authenticate with a secret
+		Confidential bool `json:"confidential"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" || len(params.Name) > 100 {
+		respondWithError(w, http.StatusBadRequest, "Name must be between 1 and 100 characters")
+		return
+	}
+	if len(params.RedirectURIs) == 0 || len(params.RedirectURIs) > maxRedirectURIs {
+		respondWithError(w, http.StatusBadRequest, "Between 1 and 10 redirect URIs are required")
+		return
+	}
+	for _, redirectURI := range params.RedirectURIs {
+		if !validRedirectURI(redirectURI) {
+			respondWithError(w, http.StatusBadRequest, "Redirect URIs must use https, or http on localhost")
+			return
+		}
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to register client")
+		return
+	}
+	client := database.OAuthClient{
+		Id:           base64.RawURLEncoding.EncodeToString(id),
+		OwnerId:      userId,
+		Name:         params.Name,
+		RedirectURIs: params.RedirectURIs,
+	}
+
+	secret := ""
+	if params.Confidential {
+		secret, client.SecretHash, err = auth.NewOpaqueToken()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Unable to register client")
+			return
+		}
+	}
+
+	client, err = cfg.db.CreateOAuthClient(client)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to register client")
+		return
+	}
+
+	// the secret is only ever shown here
+	response := struct {
+		OAuthClient
+		Secret string `json:"client_secret,omitempty"`
+	}{
+		OAuthClient: newOAuthClientResponse(client),
+		Secret:      secret,
+	}
+	respondWithJSON(w, http.StatusCreated, response)
+}
+
+func (cfg *apiConfig) getOAuthClients(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	clients, err := cfg.db.GetOAuthClients(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to get clients")
+		return
+	}
+
+	response := []OAuthClient{}
+	for _, client := range clients {
+		response = append(response, newOAuthClientResponse(client))
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) deleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	err := cfg.db.DeleteOAuthClient(userId, chi.URLParam(r, "clientId"))
+	if err != nil {
+		if errors.Is(err, database.ErrOAuthClientNotFound) {
+			respondWithError(w, http.StatusNotFound, "Client not found")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to delete client")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, "")
+}
+
+// authorizationRequest is a validated request for the user's consent
+type authorizationRequest struct {
+	client        database.OAuthClient
+	redirectURI   string
+	scopes        []string
+	state         string
+	codeChallenge string
+}
+
+// parseAuthorizationRequest validates the parameters of an authorization
+// request. Until the client and redirect URI are known to be good, errors
+// can't be sent back to the client, so redirectable is false.
+func (cfg *apiConfig) parseAuthorizationRequest(params url.Values) (req authorizationRequest, redirectable bool, err error) {
+	client, err := cfg.db.GetOAuthClient(params.Get("client_id"))
+	if err != nil {
+		return req, false, oauthError{"invalid_client", "unknown client_id"}
+	}
+	req.client = client
+
+	// registered URIs must match exactly, and the token request repeats it
+	req.redirectURI = params.Get("redirect_uri")
+	if !slices.Contains(client.RedirectURIs, req.redirectURI) {
+		return req, false, oauthError{"invalid_request", "redirect_uri is not registered for this client"}
+	}
+	req.state = params.Get("state")
+
+	if params.Get("response_type") != "code" {
+		return req, true, oauthError{"unsupported_response_type", "only the code response type is supported"}
+	}
+
+	// PKCE is required for every client, and only with S256
+	req.codeChallenge = params.Get("code_challenge")
+	if req.codeChallenge == "" {
+		return req, true, oauthError{"invalid_request", "code_challenge is required"}
+	}
+	if params.Get("code_challenge_method") != "S256" {
+		return req, true, oauthError{"invalid_request", "code_challenge_method must be S256"}
+	}
+
+	req.scopes, err = parseScopes(params.Get("scope"))
+	if err != nil {
+		return req, true, err
+	}
+
+	return req, true, nil
+}
+
+// redirectWith adds query parameters to the client's redirect URI
+func (req authorizationRequest) redirectWith(params url.Values) string {
+	u, _ := url.Parse(req.redirectURI)
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if req.state != "" {
+		query.Set("state", req.state)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (req authorizationRequest) redirectWithError(err error) string {
+	oauthErr := oauthError{"server_error", ""}
+	errors.As(err, &oauthErr)
+
+	params := url.Values{}
+	params.Set("error", oauthErr.Code)
+	if oauthErr.Description != "" {
+		params.Set("error_description", oauthErr.Description)
+	}
+	return req.redirectWith(params)
+}
+
+// authorize is where third-party apps send the user. Valid requests are
+// passed on to the consent page, which signs the user in if needed.
+func (cfg *apiConfig) authorize(w http.ResponseWriter, r *http.Request) {
+	req, redirectable, err := cfg.parseAuthorizationRequest(r.URL.Query())
+	if err != nil {
+		if !redirectable {
+			respondWithOAuthError(w, http.StatusBadRequest, err)
+			return
+		}
+		http.Redirect(w, r, req.redirectWithError(err), http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, consentPagePath+"?"+r.URL.RawQuery, http.StatusFound)
+}
+
+// getAuthorizationRequest describes a request for the consent page to show
+func (cfg *apiConfig) getAuthorizationRequest(w http.ResponseWriter, r *http.Request) {
+	req, _, err := cfg.parseAuthorizationRequest(r.URL.Query())
+	if err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	response := struct {
+		ClientName  string   `json:"client_name"`
+		RedirectURI string   `json:"redirect_uri"`
+		Scopes      []string `json:"scopes"`
+	}{
+		ClientName:  req.client.Name,
+		RedirectURI: req.redirectURI,
+		Scopes:      req.scopes,
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// decideAuthorization records the signed in user's answer on the consent
+// page and tells the page where to send them back to
+func (cfg *apiConfig) decideAuthorization(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	type requestParameters struct {
+		// the authorization request query string, as passed to the consent page
+		Request string `json:"request"`
+		Approve bool   `json:"approve"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	query, err := url.ParseQuery(strings.TrimPrefix(params.Request, "?"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid authorization request")
+		return
+	}
+
+	req, redirectable, err := cfg.parseAuthorizationRequest(query)
+	if err != nil && !redirectable {
+		respondWithOAuthError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	redirectTo := ""
+	switch {
+	case err != nil:
+		redirectTo = req.redirectWithError(err)
+	case !params.Approve:
+		redirectTo = req.redirectWithError(oauthError{"access_denied", "the user denied the request"})
+	default:
+		code, hash, err := auth.NewOpaqueToken()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Unable to authorize")
+			return
+		}
+		err = cfg.db.CreateAuthorizationCode(hash, database.AuthorizationCode{
+			ClientId:      req.client.Id,
+			UserId:        userId,
+			RedirectURI:   req.redirectURI,
+			Scopes:        req.scopes,
+			CodeChallenge: req.codeChallenge,
+			ExpiresAt:     time.Now().Add(authorizationCodeLifetime),
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Unable to authorize")
+			return
+		}
+		redirectTo = req.redirectWith(url.Values{"code": {code}})
+	}
+
+	response := struct {
+		RedirectTo string `json:"redirect_to"`
+	}{
+		RedirectTo: redirectTo,
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// authenticateClient checks the client credentials on a token, revoke or
+// introspect request, sent either with HTTP Basic auth or in the form
+func (cfg *apiConfig) authenticateClient(r *http.Request) (database.OAuthClient, error) {
+	clientId, secret, ok := r.BasicAuth()
+	if ok {
+		// Basic credentials are form encoded first, RFC 6749 section 2.3.1
+		var err error
+		clientId, err = url.QueryUnescape(clientId)
+		if err != nil {
+			return database.OAuthClient{}, oauthError{"invalid_client", "malformed credentials"}
+		}
+		secret, err = url.QueryUnescape(secret)
+		if err != nil {
+			return database.OAuthClient{}, oauthError{"invalid_client", "malformed credentials"}
+		}
+	} else {
+		clientId = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := cfg.db.GetOAuthClient(clientId)
+	if err != nil {
+		return database.OAuthClient{}, oauthError{"invalid_client", "unknown client"}
+	}
+
+	if client.Confidential() {
+		hash := auth.HashToken(secret)
+		if secret == "" || subtle.ConstantTimeCompare([]byte(hash), []byte(client.SecretHash)) != 1 {
+			return database.OAuthClient{}, oauthError{"invalid_client", "client authentication failed"}
+		}
+	} else if secret != "" {
+		return database.OAuthClient{}, oauthError{"invalid_client", "public clients have no secret"}
+	}
+
+	return client, nil
+}
+
+// oauthToken is the token endpoint, exchanging an authorization code or a
+// refresh token for new tokens
+func (cfg *apiConfig) oauthToken(w http.ResponseWriter, r *http.Request) {
+	// OAuth clients expect JSON to be labelled as such
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, oauthError{"invalid_request", "malformed form body"})
+		return
+	}
+
+	client, err := cfg.authenticateClient(r)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	var userId int
+	var session database.Session
+	var refreshToken string
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		userId, session, refreshToken, err = cfg.exchangeAuthorizationCode(r, client)
+	case "refresh_token":
+		userId, session, refreshToken, err = cfg.exchangeRefreshToken(r, client)
+	default:
+		err = oauthError{"unsupported_grant_type", "grant_type must be authorization_code or refresh_token"}
+	}
+	if err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	accessToken, err := cfg.issueAccessToken(userId, session)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, oauthError{"server_error", ""})
+		return
+	}
+
+	response := struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+	}{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenLifetime.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        strings.Join(session.Scopes, " "),
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) exchangeAuthorizationCode(r *http.Request, client database.OAuthClient) (int, database.Session, string, error) {
+	invalidGrant := oauthError{"invalid_grant", "authorization code is invalid or expired"}
+
+	code, err := cfg.db.ConsumeAuthorizationCode(auth.HashToken(r.PostForm.Get("code")))
+	if err != nil {
+		if errors.Is(err, database.ErrAuthorizationCodeInvalid) {
+			return 0, database.Session{}, "", invalidGrant
+		}
+		return 0, database.Session{}, "", err
+	}
+	if code.ClientId != client.Id || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		return 0, database.Session{}, "", invalidGrant
+	}
+
+	// PKCE, RFC 7636 section 4.6
+	verifier := r.PostForm.Get("code_verifier")
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return 0, database.Session{}, "", oauthError{"invalid_grant", "code_verifier must be 43 to 128 characters"}
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(challenge), []byte(code.CodeChallenge)) != 1 {
+		return 0, database.Session{}, "", oauthError{"invalid_grant", "code_verifier does not match"}
+	}
+
+	refreshToken, err := auth.IssueJWT("chirpy-refresh", code.UserId, cfg.jwtKeys, refreshTokenLifetime)
+	if err != nil {
+		return 0, database.Session{}, "", err
+	}
+
+	sessionClient := sessionClient(r, client.Name)
+	sessionClient.ClientId = client.Id
+	sessionClient.Scopes = code.Scopes
+	session, err := cfg.db.AddToken(auth.HashToken(refreshToken), code.UserId, time.Now().Add(refreshTokenLifetime), sessionClient)
+	if err != nil {
+		return 0, database.Session{}, "", err
+	}
+
+	return code.UserId, session, refreshToken, nil
+}
+
+func (cfg *apiConfig) exchangeRefreshToken(r *http.Request, client database.OAuthClient) (int, database.Session, string, error) {
+	invalidGrant := oauthError{"invalid_grant", "refresh token is invalid or revoked"}
+
+	token := r.PostForm.Get("refresh_token")
+	_, claims, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil || claims.Issuer != "chirpy-refresh" {
+		return 0, database.Session{}, "", invalidGrant
+	}
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, database.Session{}, "", invalidGrant
+	}
+
+	newRefreshToken, err := auth.IssueJWT("chirpy-refresh", userId, cfg.jwtKeys, refreshTokenLifetime)
+	if err != nil {
+		return 0, database.Session{}, "", err
+	}
+
+	session, err := cfg.db.RotateToken(auth.HashToken(token), auth.HashToken(newRefreshToken), time.Now().Add(refreshTokenLifetime), client.Id, sessionClient(r, ""))
+	if err != nil {
+		if errors.Is(err, database.ErrTokenReused) || errors.Is(err, database.ErrTokenRevoked) || errors.Is(err, database.ErrTokenNotFound) {
+			return 0, database.Session{}, "", invalidGrant
+		}
+		return 0, database.Session{}, "", err
+	}
+
+	return userId, session, newRefreshToken, nil
+}
+
+// oauthRevoke is the RFC 7009 revocation endpoint. Revoking either token
+// signs the whole session out. Unknown tokens are not an error.
+func (cfg *apiConfig) oauthRevoke(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, oauthError{"invalid_request", "malformed form body"})
+		return
+	}
+
+	client, err := cfg.authenticateClient(r)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	session, ok := cfg.sessionForClientToken(r.PostForm.Get("token"), client)
+	if ok {
+		err = cfg.db.RevokeSession(session.UserId, session.Id)
+		if err != nil && !errors.Is(err, database.ErrSessionNotFound) {
+			respondWithOAuthError(w, http.StatusServiceUnavailable, oauthError{"temporarily_unavailable", ""})
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// oauthIntrospect is the RFC 7662 introspection endpoint. Clients can only
+// introspect their own tokens, anything else is reported as inactive.
+func (cfg *apiConfig) oauthIntrospect(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, oauthError{"invalid_request", "malformed form body"})
+		return
+	}
+
+	client, err := cfg.authenticateClient(r)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	type introspection struct {
+		Active    bool   `json:"active"`
+		Scope     string `json:"scope,omitempty"`
+		ClientId  string `json:"client_id,omitempty"`
+		Subject   string `json:"sub,omitempty"`
+		TokenType string `json:"token_type,omitempty"`
+		ExpiresAt int64  `json:"exp,omitempty"`
+		IssuedAt  int64  `json:"iat,omitempty"`
+	}
+
+	token := r.PostForm.Get("token")
+	session, ok := cfg.sessionForClientToken(token, client)
+	if !ok || session.RevokedAt != (time.Time{}) {
+		respondWithJSON(w, http.StatusOK, introspection{Active: false})
+		return
+	}
+
+	// the session is live, the token itself must still be too
+	_, claims, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithJSON(w, http.StatusOK, introspection{Active: false})
+		return
+	}
+	tokenType := "access_token"
+	if claims.Issuer == "chirpy-refresh" {
+		tokenType = "refresh_token"
+		dat, _, err := cfg.db.GetTokenSession(auth.HashToken(token))
+		if err != nil || dat.RotatedAt != (time.Time{}) || dat.RevokedAt != (time.Time{}) {
+			respondWithJSON(w, http.StatusOK, introspection{Active: false})
+			return
+		}
+	}
+
+	response := introspection{
+		Active:    true,
+		Scope:     strings.Join(session.Scopes, " "),
+		ClientId:  client.Id,
+		Subject:   claims.Subject,
+		TokenType: tokenType,
+	}
+	if claims.ExpiresAt != nil {
+		response.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		response.IssuedAt = claims.IssuedAt.Unix()
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// sessionForClientToken finds the session an access or refresh token belongs
+// to, as long as it was granted to client
+func (cfg *apiConfig) sessionForClientToken(token string, client database.OAuthClient) (database.Session, bool) {
+	_, claims, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		return database.Session{}, false
+	}
+
+	var session database.Session
+	switch claims.Issuer {
+	case "chirpy-access":
+		session, err = cfg.db.GetSession(claims.SessionId)
+	case "chirpy-refresh":
+		_, session, err = cfg.db.GetTokenSession(auth.HashToken(token))
+	default:
+		return database.Session{}, false
+	}
+	if err != nil || session.ClientId != client.Id {
+		return database.Session{}, false
+	}
+
+	return session, true
+}
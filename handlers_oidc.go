@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
+)
+
+// remembers a sign in between leaving for the provider and coming back
+const oidcCookieName = "chirpy_oidc"
+
+// how long the user has to sign in at the provider
+const oidcLoginTimeout = 10 * time.Minute
+
+// the callback path the provider redirects back to, registered with the provider
+const oidcCallbackPath = "/api/login/oidc/callback"
+
+// the page the callback sends the browser on to once the user is known
+const oidcLandingPath = "/app/login/oidc.html"
+
+// startOIDCLogin sends the user to the provider to sign in. The state, nonce
+// and PKCE verifier are kept in a cookie scoped to the callback, so they
+// can't be replayed from another browser.
+func (cfg *apiConfig) startOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if cfg.oidc == nil {
+		respondWithError(w, http.StatusNotFound, "OpenID Connect login is not configured")
+		return
+	}
+
+	values := make([]string, 3)
+	for i := range values {
+		value, _, err := auth.NewOpaqueToken()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Unable to start login")
+			return
+		}
+		values[i] = value
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	authURL, err := cfg.oidc.AuthCodeURL(r.Context(), state, nonce, challenge)
+	if err != nil {
+		fmt.Println("OpenID Connect discovery failed:", err)
+		respondWithError(w, http.StatusBadGateway, "Unable to reach the login provider")
+		return
+	}
+
+	// Lax so the cookie comes along on the provider's redirect back
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    strings.Join(values, "."),
+		Path:     oidcCallbackPath,
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(cfg.baseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcCallback is where the provider sends the user back to. The identity in
+// the ID token is linked to a user by verified email the first time, and the
+// browser is signed in with a cookie session.
+func (cfg *apiConfig) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	if cfg.oidc == nil {
+		respondWithError(w, http.StatusNotFound, "OpenID Connect login is not configured")
+		return
+	}
+
+	// the cookie is single use whatever happens next
+	cookie, err := r.Cookie(oidcCookieName)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Path:     oidcCallbackPath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(cfg.baseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Login expired, please try again")
+		return
+	}
+	values := strings.Split(cookie.Value, ".")
+	if len(values) != 3 {
+		respondWithError(w, http.StatusBadRequest, "Login expired, please try again")
+		return
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	query := r.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+		respondWithError(w, http.StatusBadRequest, "Login state does not match, please try again")
+		return
+	}
+	if query.Get("error") != "" {
+		respondWithError(w, http.StatusUnauthorized, "Login was cancelled at the provider")
+		return
+	}
+
+	identity, err := cfg.oidc.Exchange(r.Context(), query.Get("code"), verifier, nonce)
+	if err != nil {
+		fmt.Println("OpenID Connect login failed:", err)
+		respondWithError(w, http.StatusUnauthorized, "Unable to verify login with the provider")
+		return
+	}
+
+	// only an address the provider checked can be trusted to pick the account
+	if !identity.EmailVerified || !validEmail(identity.Email) {
+		respondWithError(w, http.StatusForbidden, "Your account at the provider has no verified email address")
+		return
+	}
+
+	user, err := cfg.db.SignInWithIdentity(identity.Issuer, identity.Subject, identity.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to sign in")
+		return
+	}
+
+	// this is a browser navigation, so no tokens go in the response. The
+	// sign in page picks up the cookie session, or asks for the second factor.
+	if user.TOTPEnabled {
+		challenge, err := auth.IssueJWT("chirpy-2fa", user.Id, cfg.jwtKeys, twoFactorChallengeExpiry)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Unable to issue challenge")
+			return
+		}
+		// the fragment isn't sent to servers or in the Referer header
+		fragment := url.Values{"challenge": {challenge}}
+		http.Redirect(w, r, oidcLandingPath+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+
+	_, refreshToken, ok := cfg.startSession(w, r, user, "")
+	if !ok {
+		return
+	}
+	_, err = setSessionCookies(w, refreshToken)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to issue refresh token")
+		return
+	}
+	http.Redirect(w, r, oidcLandingPath, http.StatusFound)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/mailer"
+)
+
+const passwordResetTokenLifetime = time.Hour
+
+func (cfg *apiConfig) requestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	type requestParameters struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	// the response is the same, and takes as long, whether or not the
+	// account exists, so this endpoint can't be used to find out who has signed up
+	user, err := cfg.db.GetUserByEmail(params.Email)
+	if err == nil {
+		go func() {
+			err := cfg.sendPasswordResetEmail(user)
+			if err != nil {
+				fmt.Println("Unable to send password reset email:", err)
+			}
+		}()
+	} else if !errors.Is(err, database.ErrUserNotFound) {
+		fmt.Println("Unable to look up user for password reset:", err)
+	}
+
+	respondWithJSON(w, http.StatusAccepted, "")
+}
+
+func (cfg *apiConfig) sendPasswordResetEmail(user database.User) error {
+	token, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	err = cfg.db.CreateOneTimeToken(user.Id, database.TokenPurposeResetPassword, hash, time.Now().Add(passwordResetTokenLifetime))
+	if err != nil {
+		return err
+	}
+
+	return cfg.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf(`Someone asked to reset the password for your Chirpy account.
+
+To choose a new password, send this token along with it to %s/api/password-reset/confirm:
+
+%s
+
+The token can be used once and expires in 1 hour. If you didn't ask for this you can ignore this email, your password hasn't changed.
+`, cfg.baseURL, token),
+	})
+}
+
+func (cfg *apiConfig) confirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	type requestParameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err := decoder.Decode(&params)
+	if err != nil || params.Token == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if params.Password == "" {
+		respondWithError(w, http.StatusBadRequest, "Password can't be empty")
+		return
+	}
+
+	// hash before using up the token so a failure here doesn't burn it
+	hashedPassword, ok := cfg.hashPassword(w, params.Password)
+	if !ok {
+		return
+	}
+
+	token, err := cfg.db.ConsumeOneTimeToken(auth.HashToken(params.Token), database.TokenPurposeResetPassword)
+	if err != nil {
+		if errors.Is(err, database.ErrOneTimeTokenInvalid) {
+			respondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to reset password")
+		return
+	}
+
+	_, err = cfg.db.SetPassword(token.UserId, hashedPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to reset password")
+		return
+	}
+
+	// sign out everywhere, whoever knew the old password may hold a session
+	err = cfg.db.RevokeUserTokens(token.UserId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to revoke existing sessions")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, "")
+}
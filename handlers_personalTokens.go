@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+	"golang.org/x/exp/slices"
+)
+
+// personal access tokens start with this so they're easy to spot in code and logs
+const personalTokenPrefix = "chirpy_pat_"
+
+const maxPersonalTokenNameLength = 100
+
+type PersonalToken struct {
+	Id         int       `json:"id"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func newPersonalTokenResponse(token database.PersonalAccessToken) PersonalToken {
+	return PersonalToken{
+		Id:         token.Id,
+		Name:       token.Name,
+		Scopes:     token.Scopes,
+		CreatedAt:  token.CreatedAt,
+		LastUsedAt: token.LastUsedAt,
+		ExpiresAt:  token.ExpiresAt,
+	}
+}
+
+// authenticatePersonalToken is the principal for a personal access token,
+// limited to the scopes it was created with
+func (cfg *apiConfig) authenticatePersonalToken(token string) (auth.Principal, error) {
+	if !strings.HasPrefix(token, personalTokenPrefix) {
+		return auth.Principal{}, errors.New("unrecognized token")
+	}
+
+	personalToken, err := cfg.db.UsePersonalAccessToken(auth.HashToken(token))
+	if err != nil {
+		return auth.Principal{}, err
+	}
+
+	return auth.Principal{
+		UserId: personalToken.UserId,
+		Scopes: personalToken.Scopes,
+	}, nil
+}
+
+func (cfg *apiConfig) createPersonalToken(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	type requestParameters struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+		// zero for a token that never expires
+		ExpiresInDays int `json:"expires_in_days"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" || len(params.Name) > maxPersonalTokenNameLength {
+		respondWithError(w, http.StatusBadRequest, "Name must be between 1 and 100 characters")
+		return
+	}
+	// a token without scopes would have full access, so at least one is required
+	if len(params.Scopes) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one scope is required")
+		return
+	}
+	scopes := []string{}
+	for _, scope := range params.Scopes {
+		if !slices.Contains(grantableScopes, scope) {
+			respondWithError(w, http.StatusBadRequest, "Unknown scope "+scope)
+			return
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if params.ExpiresInDays < 0 {
+		respondWithError(w, http.StatusBadRequest, "expires_in_days can't be negative")
+		return
+	}
+	expiresAt := time.Time{}
+	if params.ExpiresInDays > 0 {
+		expiresAt = time.Now().AddDate(0, 0, params.ExpiresInDays)
+	}
+
+	secret, _, err := auth.NewOpaqueToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to create token")
+		return
+	}
+	token := personalTokenPrefix + secret
+
+	personalToken, err := cfg.db.CreatePersonalAccessToken(userId, params.Name, scopes, auth.HashToken(token), expiresAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to create token")
+		return
+	}
+
+	// the token itself is only ever shown here
+	response := struct {
+		PersonalToken
+		Token string `json:"token"`
+	}{
+		PersonalToken: newPersonalTokenResponse(personalToken),
+		Token:         token,
+	}
+	respondWithJSON(w, http.StatusCreated, response)
+}
+
+func (cfg *apiConfig) getPersonalTokens(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	tokens, err := cfg.db.GetPersonalAccessTokens(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to get tokens")
+		return
+	}
+
+	response := []PersonalToken{}
+	for _, token := range tokens {
+		response = append(response, newPersonalTokenResponse(token))
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) deletePersonalToken(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	tokenId, err := strconv.Atoi(chi.URLParam(r, "tokenId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid token id")
+		return
+	}
+
+	err = cfg.db.DeletePersonalAccessToken(userId, tokenId)
+	if err != nil {
+		if errors.Is(err, database.ErrPersonalTokenNotFound) {
+			respondWithError(w, http.StatusNotFound, "Token not found")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to revoke token")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, "")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+)
+
+const minPollOptions = 2
+const maxPollOptions = 4
+
+// define poll so that individual votes won't be written to json
+type PollResponse struct {
+	ChirpId     int       `json:"chirp_id"`
+	Options     []string  `json:"options"`
+	ClosesAt    time.Time `json:"closes_at"`
+	IsClosed    bool      `json:"is_closed"`
+	VotedOption *int      `json:"voted_option,omitempty"`
+	Results     []int     `json:"results,omitempty"`
+}
+
+type pollParameters struct {
+	Options  []string  `json:"options"`
+	ClosesAt time.Time `json:"closes_at"`
+}
+
+func (params pollParameters) validate() error {
+	if len(params.Options) < minPollOptions || len(params.Options) > maxPollOptions {
+		return errors.New("poll must have between 2 and 4 options")
+	}
+	for _, option := range params.Options {
+		if strings.TrimSpace(option) == "" {
+			return errors.New("poll options can't be empty")
+		}
+	}
+	if !params.ClosesAt.After(time.Now()) {
+		return errors.New("poll must close in the future")
+	}
+	return nil
+}
+
+// newPollResponse hides the results until the viewer has voted or the poll has closed
+func newPollResponse(poll database.Poll, viewerId int) PollResponse {
+	response := PollResponse{
+		ChirpId:  poll.ChirpId,
+		Options:  poll.Options,
+		ClosesAt: poll.ClosesAt,
+		IsClosed: poll.IsClosed(time.Now()),
+	}
+
+	if option, ok := poll.Votes[viewerId]; ok && viewerId != 0 {
+		response.VotedOption = &option
+	}
+
+	if response.IsClosed || response.VotedOption != nil {
+		response.Results = poll.Tally()
+	}
+
+	return response
+}
+
+func (cfg *apiConfig) getPoll(w http.ResponseWriter, r *http.Request) {
+	chirpId, err := strconv.Atoi(chi.URLParam(r, "chirpId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "unknown chirp id")
+		return
+	}
+
+	// authentication is optional here, it only decides whether results are shown
+	viewerId := currentUserId(r)
+
+	poll, err := cfg.db.GetPoll(chirpId)
+	if err != nil {
+		if errors.Is(err, database.ErrPollNotFound) {
+			respondWithError(w, http.StatusNotFound, "Poll not found")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Error getting poll")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newPollResponse(poll, viewerId))
+}
+
+func (cfg *apiConfig) voteOnPoll(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	if !cfg.requireVerified(w, userId, restrictPolls) {
+		return
+	}
+
+	chirpId, err := strconv.Atoi(chi.URLParam(r, "chirpId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "unknown chirp id")
+		return
+	}
+
+	type requestParameters struct {
+		Option *int `json:"option"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err = decoder.Decode(&params)
+	if err != nil || params.Option == nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	// voting counts as reacting, which the chirp's author may have blocked
+	chirp, err := cfg.db.GetChirp(chirpId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Poll not found")
+		return
+	}
+	blocked, err := cfg.db.IsBlockedBy(userId, chirp.AuthorId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to record vote")
+		return
+	}
+	if blocked {
+		respondWithError(w, http.StatusForbidden, "You can't vote on this poll")
+		return
+	}
+
+	poll, err := cfg.db.VotePoll(chirpId, userId, *params.Option)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrPollNotFound):
+			respondWithError(w, http.StatusNotFound, "Poll not found")
+		case errors.Is(err, database.ErrPollClosed):
+			respondWithError(w, http.StatusConflict, "Poll is closed")
+		case errors.Is(err, database.ErrPollAlreadyVoted):
+			respondWithError(w, http.StatusConflict, "You have already voted")
+		case errors.Is(err, database.ErrPollInvalidOption):
+			respondWithError(w, http.StatusBadRequest, "Invalid poll option")
+		default:
+			respondWithError(w, http.StatusInternalServerError, "Unable to record vote")
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, newPollResponse(poll, userId))
+}
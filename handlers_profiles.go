@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+	"golang.org/x/exp/slices"
+)
+
+const maxDisplayNameLength = 50
+const maxBioLength = 160
+const maxAvatarSize = 1 << 20
+
+// avatars are written below the file server root so /app can serve them
+const avatarDir = "assets/avatars"
+
+var handlePattern = regexp.MustCompile(`^[a-zA-Z0-9_]{3,20}$`)
+
+var mentionPattern = regexp.MustCompile(`(?:^|\s)@(\w+)`)
+
+var avatarExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// Profile is the public view of a user, it never includes the email
+type Profile struct {
+	Id          int    `json:"id"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	AvatarURL   string `json:"avatar_url"`
+	IsRed       bool   `json:"is_chirpy_red"`
+}
+
+// Author is the compact profile embedded in chirps
+type Author struct {
+	Id          int    `json:"id"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url"`
+}
+
+func (cfg *apiConfig) avatarURL(user database.User) string {
+	if user.AvatarPath == "" {
+		return ""
+	}
+	return cfg.baseURL + "/app/" + user.AvatarPath
+}
+
+func (cfg *apiConfig) newProfileResponse(user database.User) Profile {
+	return Profile{
+		Id:          user.Id,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarURL:   cfg.avatarURL(user),
+		IsRed:       user.IsRed,
+	}
+}
+
+func (cfg *apiConfig) newAuthorResponse(user database.User) Author {
+	return Author{
+		Id:          user.Id,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		AvatarURL:   cfg.avatarURL(user),
+	}
+}
+
+// extractMentions returns the distinct lowercase handles mentioned in a chirp body
+func extractMentions(body string) []string {
+	handles := []string{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		handle := strings.ToLower(match[1])
+		if !slices.Contains(handles, handle) {
+			handles = append(handles, handle)
+		}
+	}
+	return handles
+}
+
+func (cfg *apiConfig) getUserProfile(w http.ResponseWriter, r *http.Request) {
+	userId, err := strconv.Atoi(chi.URLParam(r, "userId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "unknown user id")
+		return
+	}
+
+	user, err := cfg.db.GetUserById(userId)
+	cfg.respondWithProfile(w, user, err)
+}
+
+func (cfg *apiConfig) getUserProfileByHandle(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.db.GetUserByHandle(chi.URLParam(r, "handle"))
+	cfg.respondWithProfile(w, user, err)
+}
+
+func (cfg *apiConfig) respondWithProfile(w http.ResponseWriter, user database.User, err error) {
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			respondWithError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to find user")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.newProfileResponse(user))
+}
+
+func (cfg *apiConfig) updateProfile(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	if !cfg.requireVerified(w, userId, restrictProfile) {
+		return
+	}
+
+	type requestParameters struct {
+		Handle      string `json:"handle"`
+		DisplayName string `json:"display_name"`
+		Bio         string `json:"bio"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if params.Handle != "" && !handlePattern.MatchString(params.Handle) {
+		respondWithError(w, http.StatusBadRequest, "Handles are 3-20 letters, digits or underscores")
+		return
+	}
+	if len([]rune(params.DisplayName)) > maxDisplayNameLength {
+		respondWithError(w, http.StatusBadRequest, "Display name is too long")
+		return
+	}
+	if len([]rune(params.Bio)) > maxBioLength {
+		respondWithError(w, http.StatusBadRequest, "Bio is too long")
+		return
+	}
+
+	user, err := cfg.db.UpdateProfile(userId, params.Handle, strings.TrimSpace(params.DisplayName), strings.TrimSpace(params.Bio))
+	if err != nil {
+		if errors.Is(err, database.ErrHandleTaken) {
+			respondWithError(w, http.StatusConflict, "Handle already taken")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to update profile")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.newProfileResponse(user))
+}
+
+func (cfg *apiConfig) uploadAvatar(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	if !cfg.requireVerified(w, userId, restrictProfile) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarSize+1024)
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Expected an avatar image of at most 1MB")
+		return
+	}
+	defer file.Close()
+
+	dat, err := io.ReadAll(io.LimitReader(file, maxAvatarSize+1))
+	if err != nil || len(dat) > maxAvatarSize {
+		respondWithError(w, http.StatusBadRequest, "Expected an avatar image of at most 1MB")
+		return
+	}
+
+	// trust the content, not the client supplied content type
+	ext, ok := avatarExtensions[http.DetectContentType(dat)]
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Avatar must be a png, jpeg, gif or webp image")
+		return
+	}
+
+	user, err := cfg.db.GetUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to find user")
+		return
+	}
+
+	// a new name per upload so cached copies of the old avatar aren't served
+	suffix := make([]byte, 8)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to save avatar")
+		return
+	}
+	avatarPath := avatarDir + "/" + strconv.Itoa(userId) + "-" + hex.EncodeToString(suffix) + ext
+
+	err = os.MkdirAll(filepath.Join(filepathRoot, avatarDir), 0755)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to save avatar")
+		return
+	}
+	err = os.WriteFile(filepath.Join(filepathRoot, avatarPath), dat, 0644)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to save avatar")
+		return
+	}
+
+	updatedUser, err := cfg.db.SetAvatar(userId, avatarPath)
+	if err != nil {
+		os.Remove(filepath.Join(filepathRoot, avatarPath))
+		respondWithError(w, http.StatusInternalServerError, "Unable to save avatar")
+		return
+	}
+
+	if user.AvatarPath != "" {
+		os.Remove(filepath.Join(filepathRoot, user.AvatarPath))
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.newProfileResponse(updatedUser))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+	"golang.org/x/exp/slices"
+)
+
+var reactionKinds = []string{"like", "love", "laugh", "wow", "sad"}
+
+// reactToChirp sets the current user's reaction to a chirp, reacting again
+// with another kind changes it
+func (cfg *apiConfig) reactToChirp(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	chirpId, err := strconv.Atoi(chi.URLParam(r, "chirpId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "unknown chirp id")
+		return
+	}
+
+	type requestParameters struct {
+		Kind string `json:"kind"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err = decoder.Decode(&params)
+	if err != nil || !slices.Contains(reactionKinds, params.Kind) {
+		respondWithError(w, http.StatusBadRequest, "Reaction kind must be one of like, love, laugh, wow or sad")
+		return
+	}
+
+	chirp, err := cfg.db.GetChirp(chirpId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Chirp not found")
+		return
+	}
+	blocked, err := cfg.db.IsBlockedBy(userId, chirp.AuthorId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to record reaction")
+		return
+	}
+	if blocked {
+		respondWithError(w, http.StatusForbidden, "You can't react to this chirp")
+		return
+	}
+
+	reaction, created, err := cfg.db.SetReaction(chirpId, userId, params.Kind)
+	if err != nil {
+		if errors.Is(err, database.ErrChirpNotFound) {
+			respondWithError(w, http.StatusNotFound, "Chirp not found")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to record reaction")
+		return
+	}
+
+	// changing the kind of a reaction doesn't notify the author again
+	status := http.StatusOK
+	if created {
+		cfg.notify(chirp.AuthorId, database.NotificationReaction, userId, chirpId)
+		status = http.StatusCreated
+	}
+	respondWithJSON(w, status, reaction)
+}
+
+func (cfg *apiConfig) deleteReaction(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	chirpId, err := strconv.Atoi(chi.URLParam(r, "chirpId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "unknown chirp id")
+		return
+	}
+
+	err = cfg.db.DeleteReaction(chirpId, userId)
+	if err != nil {
+		if errors.Is(err, database.ErrReactionNotFound) {
+			respondWithError(w, http.StatusNotFound, "You haven't reacted to this chirp")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to remove reaction")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, "")
+}
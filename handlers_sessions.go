@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+)
+
+// longer names are cut short, they're only for the user to tell devices apart
+const maxDeviceNameLength = 100
+
+type Session struct {
+	Id         int       `json:"id"`
+	DeviceName string    `json:"device_name"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	// set for sessions granted to a third-party app
+	ClientId string   `json:"client_id,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+	// whether this is the session the request was made from
+	Current bool `json:"current"`
+}
+
+func newSessionResponse(session database.Session, currentSessionId int) Session {
+	return Session{
+		Id:         session.Id,
+		DeviceName: session.DeviceName,
+		IP:         session.IP,
+		UserAgent:  session.UserAgent,
+		CreatedAt:  session.CreatedAt,
+		LastUsedAt: session.LastUsedAt,
+		ClientId:   session.ClientId,
+		Scopes:     session.Scopes,
+		Current:    session.Id == currentSessionId,
+	}
+}
+
+// sessionClient describes the device making a request. Without a name from
+// the client the session is just called "Unknown device".
+func sessionClient(r *http.Request, deviceName string) database.SessionClient {
+	if deviceName == "" {
+		deviceName = "Unknown device"
+	}
+	if len(deviceName) > maxDeviceNameLength {
+		deviceName = deviceName[:maxDeviceNameLength]
+	}
+
+	return database.SessionClient{
+		DeviceName: deviceName,
+		IP:         clientIP(r),
+		UserAgent:  r.UserAgent(),
+	}
+}
+
+func (cfg *apiConfig) getSessions(w http.ResponseWriter, r *http.Request) {
+	principal, _ := auth.PrincipalFromContext(r.Context())
+	userId := principal.UserId
+
+	sessions, err := cfg.db.GetUserSessions(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to get sessions")
+		return
+	}
+
+	response := []Session{}
+	for _, session := range sessions {
+		response = append(response, newSessionResponse(session, principal.SessionId))
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// checkSession is how the authenticator tells whether the session an access
+// token was issued for is still signed in
+func (cfg *apiConfig) checkSession(userId int, sessionId int) error {
+	session, err := cfg.db.GetSession(sessionId)
+	if err != nil {
+		return err
+	}
+	if session.UserId != userId {
+		return errors.New("session belongs to another user")
+	}
+	if session.RevokedAt != (time.Time{}) {
+		return errors.New("session has been signed out")
+	}
+	return nil
+}
+
+// deleteSession signs one device out by revoking its session, which its
+// access and refresh tokens both belong to
+func (cfg *apiConfig) deleteSession(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	sessionId, err := strconv.Atoi(chi.URLParam(r, "sessionId"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid session id")
+		return
+	}
+
+	err = cfg.db.RevokeSession(userId, sessionId)
+	if err != nil {
+		if errors.Is(err, database.ErrSessionNotFound) {
+			respondWithError(w, http.StatusNotFound, "Session not found")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to sign out session")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, "")
+}
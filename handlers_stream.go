@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/events"
+)
+
+const streamHeartbeatInterval = 15 * time.Second
+
+func (cfg *apiConfig) streamChirps(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+
+	// optional filter by author, same as getChirps
+	authorId, err := strconv.Atoi(r.URL.Query().Get("author_id"))
+	filterByAuthor := err == nil
+
+	// browsers resend Last-Event-ID on reconnect, other clients can use the query
+	lastEventIdParam := r.Header.Get("Last-Event-ID")
+	if lastEventIdParam == "" {
+		lastEventIdParam = r.URL.Query().Get("last_event_id")
+	}
+	lastEventId := int64(0)
+	if lastEventIdParam != "" {
+		lastEventId, err = strconv.ParseInt(lastEventIdParam, 10, 64)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid Last-Event-ID")
+			return
+		}
+	}
+
+	sub, missed := cfg.events.Subscribe(lastEventId)
+	defer sub.Unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(event events.Event) error {
+		if event.Type != events.ChirpCreated && event.Type != events.ChirpDeleted {
+			return nil
+		}
+		if filterByAuthor && event.AuthorId != authorId {
+			return nil
+		}
+
+		dat, err := json.Marshal(event.Data)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, dat)
+		if err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	for _, event := range missed {
+		if send(event) != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				// dropped for lagging or shutting down, the client will reconnect
+				// with its Last-Event-ID and pick up where it left off
+				return
+			}
+			if send(event) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			_, err := fmt.Fprint(w, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
 )
 
+const accessTokenLifetime = time.Hour
+
+const refreshTokenLifetime = 60 * 24 * time.Hour
+
 func (cfg *apiConfig) refreshToken(w http.ResponseWriter, r *http.Request) {
 	// check for empty body only
 	if r.Body != http.NoBody {
@@ -22,56 +30,85 @@ func (cfg *apiConfig) refreshToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	accessToken, newRefreshToken, ok := cfg.rotateRefreshToken(w, r, token)
+	if !ok {
+		return
+	}
+
+	// return new tokens
+	response := struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{
+		Token:        accessToken,
+		RefreshToken: newRefreshToken,
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// rotateRefreshToken exchanges a first-party refresh token for a new access
+// and refresh token pair. On failure it responds itself and ok is false.
+func (cfg *apiConfig) rotateRefreshToken(w http.ResponseWriter, r *http.Request, token string) (accessToken string, newRefreshToken string, ok bool) {
 	// ensure token is valid
-	_, claims, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	_, claims, err := auth.ValidateJWT(token, cfg.jwtKeys)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
-		return
+		return "", "", false
 	}
 
 	// ensure token is a refresh token
 	issuer, err := claims.GetIssuer()
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Unable to parse token")
-		return
+		return "", "", false
 	}
 	if issuer != "chirpy-refresh" {
 		respondWithError(w, http.StatusUnauthorized, "Non-refresh token received.")
-		return
-	}
-
-	// ensure token has not been revoked
-	err = cfg.db.CheckToken(token)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "token has been revoked!")
-		return
+		return "", "", false
 	}
 
-	// create new access token
 	// convert id from string to int
 	userId, err := claims.GetSubject()
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Unable to parse user Id")
-		return
+		return "", "", false
 	}
 	userIdNum, err := strconv.Atoi(userId)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Unable to parse user Id")
-		return
+		return "", "", false
 	}
-	accessToken, err := auth.IssueJWT("chirpy-access", userIdNum, cfg.jwtSecret, time.Duration(1)*time.Hour)
+	// every refresh hands out a new refresh token and retires the old one
+	newRefreshToken, err = auth.IssueJWT("chirpy-refresh", userIdNum, cfg.jwtKeys, refreshTokenLifetime)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to issue access token")
-		return
+		respondWithError(w, http.StatusInternalServerError, "Unable to issue refresh token")
+		return "", "", false
 	}
 
-	// return new token
-	response := struct {
-		Token string `json:"token"`
-	}{
-		Token: accessToken,
+	// tokens granted to OAuth clients are refreshed at /oauth/token instead
+	session, err := cfg.db.RotateToken(auth.HashToken(token), auth.HashToken(newRefreshToken), time.Now().Add(refreshTokenLifetime), "", sessionClient(r, ""))
+	if err != nil {
+		if errors.Is(err, database.ErrTokenReused) {
+			// someone else has this token too, the whole session is now revoked
+			fmt.Printf("Refresh token reused for user %d, revoking its session\n", userIdNum)
+			respondWithError(w, http.StatusUnauthorized, "token has already been used")
+			return "", "", false
+		}
+		if errors.Is(err, database.ErrTokenRevoked) || errors.Is(err, database.ErrTokenNotFound) {
+			respondWithError(w, http.StatusUnauthorized, "token has been revoked!")
+			return "", "", false
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to issue refresh token")
+		return "", "", false
 	}
-	respondWithJSON(w, http.StatusOK, response)
+
+	accessToken, err = cfg.issueAccessToken(userIdNum, session)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to issue access token")
+		return "", "", false
+	}
+
+	return accessToken, newRefreshToken, true
 }
 
 func (cfg *apiConfig) revokeToken(w http.ResponseWriter, r *http.Request) {
@@ -89,7 +126,7 @@ func (cfg *apiConfig) revokeToken(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// ensure token is valid
-	_, claims, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	_, claims, err := auth.ValidateJWT(token, cfg.jwtKeys)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
 		return
@@ -106,10 +143,29 @@ func (cfg *apiConfig) revokeToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = cfg.db.RevokeToken(token)
+	err = cfg.db.RevokeToken(auth.HashToken(token))
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Unable to revoke access token")
+		return
 	}
 
 	respondWithJSON(w, http.StatusOK, "")
 }
+
+// issueAccessToken issues an access token for a session, limited to the
+// session's scopes if it was granted to an OAuth client
+func (cfg *apiConfig) issueAccessToken(userId int, session database.Session) (string, error) {
+	claims := auth.Claims{
+		SessionId: session.Id,
+		Scope:     strings.Join(session.Scopes, " "),
+		ClientId:  session.ClientId,
+	}
+	return auth.IssueJWTWithClaims(claims, "chirpy-access", userId, cfg.jwtKeys, accessTokenLifetime)
+}
+
+// currentUserId is the user the auth middleware authenticated the request as,
+// zero for anonymous requests on routes where auth is optional
+func currentUserId(r *http.Request) int {
+	principal, _ := auth.PrincipalFromContext(r.Context())
+	return principal.UserId
+}
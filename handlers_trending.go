@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const defaultTrendingLimit = 10
+const maxTrendingLimit = 50
+
+func (cfg *apiConfig) getTrending(w http.ResponseWriter, r *http.Request) {
+	limit := defaultTrendingLimit
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 1 || limit > maxTrendingLimit {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+	}
+
+	snapshot := cfg.trending.get()
+	if len(snapshot.Hashtags) > limit {
+		snapshot.Hashtags = snapshot.Hashtags[:limit]
+	}
+	if len(snapshot.Chirps) > limit {
+		snapshot.Chirps = snapshot.Chirps[:limit]
+	}
+
+	respondWithJSON(w, http.StatusOK, snapshot)
+}
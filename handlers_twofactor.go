@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+)
+
+// how long a user has to enter their code after giving the right password
+const twoFactorChallengeExpiry = 5 * time.Minute
+
+const recoveryCodeCount = 10
+
+// totpIssuer is the account name shown in authenticator apps
+const totpIssuer = "Chirpy"
+
+func (cfg *apiConfig) enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to create secret")
+		return
+	}
+
+	sealed, err := cfg.totpSecrets.Seal(secret)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to create secret")
+		return
+	}
+
+	// enrolling again before confirming just replaces the pending secret
+	user, err := cfg.db.BeginTOTPEnrollment(userId, sealed)
+	if err != nil {
+		if errors.Is(err, database.ErrTOTPAlreadyEnabled) {
+			respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to start enrollment")
+		return
+	}
+
+	response := struct {
+		Secret          string `json:"secret"`
+		ProvisioningURI string `json:"provisioning_uri"`
+	}{
+		Secret:          secret,
+		ProvisioningURI: auth.TOTPProvisioningURI(totpIssuer, user.Email, secret),
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	type requestParameters struct {
+		Code string `json:"code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	user, err := cfg.db.GetUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to find user")
+		return
+	}
+	if user.TOTPEnabled {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	if user.TOTPSecret == "" {
+		respondWithError(w, http.StatusBadRequest, "Two-factor enrollment has not been started")
+		return
+	}
+
+	step, ok := cfg.validateTOTP(user, params.Code)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Incorrect code")
+		return
+	}
+
+	// recovery codes are only ever shown here
+	codes, hashes, err := auth.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to create recovery codes")
+		return
+	}
+
+	_, err = cfg.db.EnableTOTP(userId, step, hashes)
+	if err != nil {
+		if errors.Is(err, database.ErrTOTPAlreadyEnabled) {
+			respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to enable two-factor authentication")
+		return
+	}
+
+	response := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		RecoveryCodes: codes,
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) disableTOTP(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	type requestParameters struct {
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	user, err := cfg.db.GetUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to find user")
+		return
+	}
+
+	if !cfg.reauthenticate(w, r, user, params.Password) {
+		return
+	}
+
+	_, err = cfg.db.DisableTOTP(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to disable two-factor authentication")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, "")
+}
+
+// loginTwoFactor exchanges the challenge from loginUser and either a current
+// code or a recovery code for the usual token pair
+func (cfg *apiConfig) loginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	type requestParameters struct {
+		Challenge    string `json:"challenge"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+		DeviceName   string `json:"device_name"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	userId, err := cfg.validateTwoFactorChallenge(params.Challenge)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired challenge")
+		return
+	}
+
+	user, err := cfg.db.GetUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired challenge")
+		return
+	}
+	if !user.TOTPEnabled {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired challenge")
+		return
+	}
+
+	// six digits are easy to guess without the same lockout as passwords
+	attempt, wait := cfg.loginLimiter.Begin(user.Email, clientIP(r), time.Now())
+	if wait > 0 {
+		respondLockedOut(w, wait)
+		return
+	}
+
+	if params.RecoveryCode != "" {
+		_, err = cfg.db.UseRecoveryCode(userId, auth.HashRecoveryCode(params.RecoveryCode))
+	} else {
+		step, ok := cfg.validateTOTP(user, params.Code)
+		if !ok {
+			err = errors.New("incorrect code")
+		} else {
+			_, err = cfg.db.UseTOTPStep(userId, step)
+		}
+	}
+	if err != nil {
+		attempt.Fail(time.Now())
+		respondWithError(w, http.StatusUnauthorized, "Incorrect code")
+		return
+	}
+	attempt.Succeed()
+
+	cfg.completeLogin(w, r, user, params.DeviceName)
+}
+
+// validateTOTP checks a code against the user's sealed secret
+func (cfg *apiConfig) validateTOTP(user database.User, code string) (int64, bool) {
+	secret, err := cfg.totpSecrets.Open(user.TOTPSecret)
+	if err != nil {
+		fmt.Println("Unable to open two-factor secret:", err)
+		return 0, false
+	}
+	return auth.ValidateTOTP(secret, code, time.Now())
+}
+
+// validateTwoFactorChallenge returns the id of the user a challenge was issued to
+func (cfg *apiConfig) validateTwoFactorChallenge(challenge string) (int, error) {
+	_, claims, err := auth.ValidateJWT(challenge, cfg.jwtKeys)
+	if err != nil {
+		return 0, err
+	}
+
+	issuer, err := claims.GetIssuer()
+	if err != nil {
+		return 0, err
+	}
+	if issuer != "chirpy-2fa" {
+		return 0, errors.New("non-challenge token received")
+	}
+
+	userId, err := claims.GetSubject()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(userId)
+}
@@ -3,7 +3,11 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"net/mail"
 	"strconv"
 	"time"
 
@@ -13,10 +17,37 @@ import (
 
 // define user so that password won't be written to json
 type User struct {
-	Id       int    `json:"id"`
-	Email    string `json:"email"`
-	Password string `json:"-"`
-	IsRed    bool   `json:"is_chirpy_red"`
+	Id            int    `json:"id"`
+	Email         string `json:"email"`
+	Password      string `json:"-"`
+	IsRed         bool   `json:"is_chirpy_red"`
+	EmailVerified bool   `json:"email_verified"`
+	TwoFactor     bool   `json:"two_factor_enabled"`
+}
+
+func newUserResponse(user database.User) User {
+	return User{
+		Id:            user.Id,
+		Email:         user.Email,
+		IsRed:         user.IsRed,
+		EmailVerified: user.EmailVerified,
+		TwoFactor:     user.TOTPEnabled,
+	}
+}
+
+// clientIP is the address the request came from, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// validEmail accepts a bare address like user@example.com, without a display name
+func validEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email
 }
 
 func (cfg *apiConfig) createUser(w http.ResponseWriter, r *http.Request) {
@@ -34,10 +65,14 @@ func (cfg *apiConfig) createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !validEmail(params.Email) {
+		respondWithError(w, http.StatusBadRequest, "Invalid email address")
+		return
+	}
+
 	// hash password
-	hashedPassword, err := auth.HashPassword(params.Password)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error hashing password")
+	hashedPassword, ok := cfg.hashPassword(w, params.Password)
+	if !ok {
 		return
 	}
 
@@ -52,13 +87,14 @@ func (cfg *apiConfig) createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// send back user
-	response := User{
-		Id:    user.Id,
-		Email: user.Email,
-		IsRed: user.IsRed,
+	// a failed email isn't fatal, the user can ask for another one
+	err = cfg.sendVerificationEmail(user)
+	if err != nil {
+		fmt.Println("Unable to send verification email:", err)
 	}
-	respondWithJSON(w, http.StatusCreated, response)
+
+	// send back user
+	respondWithJSON(w, http.StatusCreated, newUserResponse(user))
 }
 
 func (cfg *apiConfig) loginUser(w http.ResponseWriter, r *http.Request) {
@@ -66,6 +102,8 @@ func (cfg *apiConfig) loginUser(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		// optional, shown in the user's list of sessions
+		DeviceName string `json:"device_name"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -77,127 +115,257 @@ func (cfg *apiConfig) loginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// get user with this email
+	// refuse to even try while the account or client is locked out
+	attempt, wait := cfg.loginLimiter.Begin(params.Email, clientIP(r), time.Now())
+	if wait > 0 {
+		respondLockedOut(w, wait)
+		return
+	}
+
+	// get user with this email. Unknown emails are answered exactly like wrong
+	// passwords, including the time spent checking the password.
 	user, err := cfg.db.GetUserByEmail(params.Email)
-	if err != nil {
+	if err != nil && !errors.Is(err, database.ErrUserNotFound) {
+		attempt.Release()
 		respondWithError(w, http.StatusInternalServerError, "Couldn't find user")
 		return
 	}
-
-	// validate password with hashed password
-	err = auth.ValidatePassword(params.Password, user.HashedPassword)
+	if errors.Is(err, database.ErrUserNotFound) {
+		err = cfg.passwords.VerifyDummy(params.Password)
+	} else {
+		// validate password with hashed password
+		err = cfg.verifyPassword(user, params.Password)
+	}
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "")
+		attempt.Fail(time.Now())
+		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password")
 		return
 	}
+	// with two-factor the login isn't over yet, failed codes keep adding
+	// to the failures a correct password would otherwise clear
+	if user.TOTPEnabled {
+		attempt.Release()
+	} else {
+		attempt.Succeed()
+	}
+
+	cfg.loginAs(w, r, user, params.DeviceName)
+}
+
+func respondLockedOut(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	respondWithError(w, http.StatusTooManyRequests, "Too many failed login attempts, try again later")
+}
+
+// reauthenticate asks a signed in user for their password again before a
+// sensitive change, since a stolen access token alone shouldn't be enough.
+// Wrong passwords count toward the lockout like failed logins.
+func (cfg *apiConfig) reauthenticate(w http.ResponseWriter, r *http.Request, user database.User, password string) bool {
+	attempt, wait := cfg.loginLimiter.Begin(user.Email, clientIP(r), time.Now())
+	if wait > 0 {
+		respondLockedOut(w, wait)
+		return false
+	}
 
-	// issue the access token
-	accessToken, err := auth.IssueJWT("chirpy-access", user.Id, cfg.jwtSecret, time.Duration(1)*time.Hour)
+	err := cfg.verifyPassword(user, password)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to issue access token")
-		return
+		attempt.Fail(time.Now())
+		if user.HashedPassword == "" {
+			respondWithError(w, http.StatusUnauthorized, "Your account has no password, set one with a password reset first")
+			return false
+		}
+		respondWithError(w, http.StatusUnauthorized, "Incorrect password")
+		return false
 	}
+	attempt.Release()
+	return true
+}
 
-	// issue the refresh token
-	refreshToken, err := auth.IssueJWT("chirpy-refresh", user.Id, cfg.jwtSecret, time.Duration(24*60)*time.Hour)
+// hashPassword hashes a new password, responding with an error itself when
+// that fails
+func (cfg *apiConfig) hashPassword(w http.ResponseWriter, password string) (string, bool) {
+	hashedPassword, err := cfg.passwords.Hash(password)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to issue refresh token")
+		if errors.Is(err, auth.ErrPasswordTooLong) {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Password can't be longer than %d bytes", cfg.passwords.MaxPasswordLength()))
+			return "", false
+		}
+		respondWithError(w, http.StatusInternalServerError, "Error hashing password")
+		return "", false
+	}
+	return hashedPassword, true
+}
+
+// verifyPassword checks a user's password. A hash made with outdated
+// parameters is replaced while the plain password is at hand.
+func (cfg *apiConfig) verifyPassword(user database.User, password string) error {
+	needsRehash, err := cfg.passwords.Verify(password, user.HashedPassword)
+	if err != nil {
+		return err
+	}
+
+	if needsRehash {
+		newHash, err := cfg.passwords.Hash(password)
+		if err == nil {
+			err = cfg.db.RehashPassword(user.Id, user.HashedPassword, newHash)
+		}
+		// the login itself still succeeded, the next one will try again
+		if err != nil {
+			fmt.Println("Unable to rehash password:", err)
+		}
+	}
+	return nil
+}
+
+// loginAs signs in a user whose first factor checked out. With two-factor
+// enabled that only earns a challenge, which is exchanged for tokens along
+// with a code at /api/login/2fa.
+func (cfg *apiConfig) loginAs(w http.ResponseWriter, r *http.Request, user database.User, deviceName string) {
+	if user.TOTPEnabled {
+		challenge, err := auth.IssueJWT("chirpy-2fa", user.Id, cfg.jwtKeys, twoFactorChallengeExpiry)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Unable to issue challenge")
+			return
+		}
+
+		response := struct {
+			TwoFactorRequired bool   `json:"two_factor_required"`
+			Challenge         string `json:"challenge"`
+		}{
+			TwoFactorRequired: true,
+			Challenge:         challenge,
+		}
+		respondWithJSON(w, http.StatusOK, response)
 		return
 	}
 
-	// add refresh token to database
-	err = cfg.db.AddToken(refreshToken)
+	cfg.completeLogin(w, r, user, deviceName)
+}
+
+// completeLogin responds to a successful login with the user and the access
+// and refresh token pair for a new session
+func (cfg *apiConfig) completeLogin(w http.ResponseWriter, r *http.Request, user database.User, deviceName string) {
+	session, refreshToken, ok := cfg.startSession(w, r, user, deviceName)
+	if !ok {
+		return
+	}
+
+	// issue the access token for the new session
+	accessToken, err := cfg.issueAccessToken(user.Id, session)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to issue refresh token")
+		respondWithError(w, http.StatusInternalServerError, "Unable to issue access token")
 		return
 	}
 
 	// return authenticated user response
 	response := struct {
-		Id           int    `json:"id"`
-		Email        string `json:"email"`
-		IsRed        bool   `json:"is_chirpy_red"`
+		User
 		Token        string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
+		RefreshToken string `json:"refresh_token,omitempty"`
+		CSRFToken    string `json:"csrf_token,omitempty"`
 	}{
-		Id:           user.Id,
-		Email:        user.Email,
-		IsRed:        user.IsRed,
+		User:         newUserResponse(user),
 		Token:        accessToken,
 		RefreshToken: refreshToken,
 	}
 
+	// cookie sessions keep the refresh token away from scripts
+	if wantsCookieSession(r) {
+		response.CSRFToken, err = setSessionCookies(w, refreshToken)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Unable to issue refresh token")
+			return
+		}
+		response.RefreshToken = ""
+	}
+
 	respondWithJSON(w, http.StatusOK, response)
 }
 
-func (cfg *apiConfig) updateUser(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.ParseBearerToken(r.Header)
+// startSession restores an account waiting to be deleted and stores a new
+// session for it, returning the session's refresh token
+func (cfg *apiConfig) startSession(w http.ResponseWriter, r *http.Request, user database.User, deviceName string) (database.Session, string, bool) {
+	err := cfg.cancelAccountDeletion(user)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Invalid token")
-		return
+		respondWithError(w, http.StatusInternalServerError, "Unable to restore account")
+		return database.Session{}, "", false
 	}
 
-	_, claims, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	// issue the refresh token
+	refreshToken, err := auth.IssueJWT("chirpy-refresh", user.Id, cfg.jwtKeys, refreshTokenLifetime)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
-		return
+		respondWithError(w, http.StatusInternalServerError, "Unable to issue refresh token")
+		return database.Session{}, "", false
 	}
 
-	issuer, err := claims.GetIssuer()
+	// add refresh token to database
+	session, err := cfg.db.AddToken(auth.HashToken(refreshToken), user.Id, time.Now().Add(refreshTokenLifetime), sessionClient(r, deviceName))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to parse token")
-		return
+		respondWithError(w, http.StatusInternalServerError, "Unable to issue refresh token")
+		return database.Session{}, "", false
 	}
 
-	if issuer != "chirpy-access" {
-		respondWithError(w, http.StatusUnauthorized, "Non-access token received.")
-		return
-	}
+	return session, refreshToken, true
+}
+
+func (cfg *apiConfig) updateUser(w http.ResponseWriter, r *http.Request) {
+	userIdNum := currentUserId(r)
 
 	// parse the request body
 	type requestParameters struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		// the password before this change
+		CurrentPassword string `json:"current_password"`
 	}
 	decoder := json.NewDecoder(r.Body)
 	params := requestParameters{}
-	err = decoder.Decode(&params)
+	err := decoder.Decode(&params)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Invalid request body")
 		return
 	}
 
-	// convert id from string to int
-	userId, err := claims.GetSubject()
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to parse user Id")
+	if !validEmail(params.Email) {
+		respondWithError(w, http.StatusBadRequest, "Invalid email address")
 		return
 	}
-	userIdNum, err := strconv.Atoi(userId)
+
+	currentUser, err := cfg.db.GetUserById(userIdNum)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to parse user Id")
+		respondWithError(w, http.StatusInternalServerError, "Unable to update user")
+		return
+	}
+
+	if !cfg.reauthenticate(w, r, currentUser, params.CurrentPassword) {
 		return
 	}
 
 	// hash password
-	hashedPassword, err := auth.HashPassword(params.Password)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error hashing password")
+	hashedPassword, ok := cfg.hashPassword(w, params.Password)
+	if !ok {
 		return
 	}
 
 	// update the user in the database
 	updatedUser, err := cfg.db.UpdateUser(userIdNum, params.Email, hashedPassword)
 	if err != nil {
+		if errors.Is(err, database.ErrUserAlreadyExists) {
+			respondWithError(w, http.StatusConflict, "Email already in use")
+			return
+		}
 		respondWithError(w, http.StatusInternalServerError, "Unable to update user")
 		return
 	}
 
-	// return updated user info
-	response := User{
-		Id:    updatedUser.Id,
-		Email: updatedUser.Email,
-		IsRed: updatedUser.IsRed,
+	// changing the address means verifying it again
+	if updatedUser.Email != currentUser.Email {
+		err = cfg.sendVerificationEmail(updatedUser)
+		if err != nil {
+			fmt.Println("Unable to send verification email:", err)
+		}
 	}
-	respondWithJSON(w, http.StatusOK, response)
+
+	// return updated user info
+	respondWithJSON(w, http.StatusOK, newUserResponse(updatedUser))
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/mailer"
+	"golang.org/x/exp/slices"
+)
+
+const verificationTokenLifetime = 24 * time.Hour
+
+// actions that can be denied to accounts with an unverified email, see UNVERIFIED_RESTRICTIONS
+const (
+	restrictChirps   = "chirps"
+	restrictMessages = "messages"
+	restrictPolls    = "polls"
+	restrictProfile  = "profile"
+)
+
+var restrictableActions = []string{restrictChirps, restrictMessages, restrictPolls, restrictProfile}
+
+func (cfg *apiConfig) sendVerificationEmail(user database.User) error {
+	token, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	err = cfg.db.CreateOneTimeToken(user.Id, database.TokenPurposeVerifyEmail, hash, time.Now().Add(verificationTokenLifetime))
+	if err != nil {
+		return err
+	}
+
+	return cfg.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your Chirpy email address",
+		Body: fmt.Sprintf(`Welcome to Chirpy!
+
+To verify your email address, send this token to %s/api/users/verify:
+
+%s
+
+The token expires in 24 hours. If you didn't sign up for Chirpy you can ignore this email.
+`, cfg.baseURL, token),
+	})
+}
+
+// requireVerified responds with a 403 and returns false when the action is
+// restricted for unverified accounts and the user hasn't verified their email
+func (cfg *apiConfig) requireVerified(w http.ResponseWriter, userId int, action string) bool {
+	if !slices.Contains(cfg.unverifiedRestrictions, action) {
+		return true
+	}
+
+	user, err := cfg.db.GetUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to find user")
+		return false
+	}
+	if !user.EmailVerified {
+		respondWithError(w, http.StatusForbidden, "Verify your email address first")
+		return false
+	}
+
+	return true
+}
+
+func (cfg *apiConfig) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	type requestParameters struct {
+		Token string `json:"token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestParameters{}
+	err := decoder.Decode(&params)
+	if err != nil || params.Token == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	token, err := cfg.db.ConsumeOneTimeToken(auth.HashToken(params.Token), database.TokenPurposeVerifyEmail)
+	if err != nil {
+		if errors.Is(err, database.ErrOneTimeTokenInvalid) {
+			respondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to verify email")
+		return
+	}
+
+	user, err := cfg.db.VerifyEmail(token.UserId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to verify email")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newUserResponse(user))
+}
+
+func (cfg *apiConfig) resendVerification(w http.ResponseWriter, r *http.Request) {
+	userId := currentUserId(r)
+
+	user, err := cfg.db.GetUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to find user")
+		return
+	}
+	if user.EmailVerified {
+		respondWithError(w, http.StatusConflict, "Email already verified")
+		return
+	}
+
+	err = cfg.sendVerificationEmail(user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to send verification email")
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, "")
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/events"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/websocket"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	websocketPingInterval = 30 * time.Second
+	// a client that hasn't answered two pings is considered gone
+	websocketReadTimeout  = 2*websocketPingInterval + 10*time.Second
+	websocketWriteTimeout = 10 * time.Second
+	// replies to client commands that may queue up before the client is dropped
+	websocketReplyBuffer = 16
+)
+
+const (
+	topicFeed          = "feed"
+	topicAuthorPrefix  = "author:"
+	topicNotifications = "notifications"
+)
+
+type websocketCommand struct {
+	Type  string `json:"type"`
+	Topic string `json:"topic"`
+}
+
+type websocketMessage struct {
+	Type    string        `json:"type"`
+	Topic   string        `json:"topic,omitempty"`
+	Event   *events.Event `json:"event,omitempty"`
+	Message string        `json:"message,omitempty"`
+}
+
+// websocketTopics is the set of topics a single connection is subscribed to
+type websocketTopics struct {
+	mux    *sync.RWMutex
+	userId int
+	topics map[string]struct{}
+	// chirps from muted users are left out of the feed, refreshed with each ping
+	mutedIds []int
+}
+
+func validTopic(topic string) bool {
+	if topic == topicFeed || topic == topicNotifications {
+		return true
+	}
+	if authorId, ok := strings.CutPrefix(topic, topicAuthorPrefix); ok {
+		_, err := strconv.Atoi(authorId)
+		return err == nil
+	}
+	return false
+}
+
+func (t *websocketTopics) set(topic string, subscribed bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if subscribed {
+		t.topics[topic] = struct{}{}
+	} else {
+		delete(t.topics, topic)
+	}
+}
+
+func (t *websocketTopics) setMuted(mutedIds []int) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.mutedIds = mutedIds
+}
+
+// match returns the subscribed topic an event should be delivered under
+func (t *websocketTopics) match(event events.Event) (string, bool) {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+
+	if event.RecipientId != 0 {
+		if _, ok := t.topics[topicNotifications]; ok && event.RecipientId == t.userId {
+			return topicNotifications, true
+		}
+		return "", false
+	}
+
+	if event.Type != events.ChirpCreated && event.Type != events.ChirpDeleted {
+		return "", false
+	}
+	if slices.Contains(t.mutedIds, event.AuthorId) {
+		return "", false
+	}
+	if _, ok := t.topics[topicFeed]; ok {
+		return topicFeed, true
+	}
+	authorTopic := topicAuthorPrefix + strconv.Itoa(event.AuthorId)
+	if _, ok := t.topics[authorTopic]; ok {
+		return authorTopic, true
+	}
+	return "", false
+}
+
+func (cfg *apiConfig) websocketHandler(w http.ResponseWriter, r *http.Request) {
+	// browsers can't set headers on websocket requests, so also accept the
+	// access token as a query parameter
+	token, err := auth.ParseBearerToken(r.Header)
+	if err != nil {
+		token = r.URL.Query().Get("access_token")
+	}
+	principal, err := cfg.authenticator.AuthenticateToken(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	// notifications come over the same connection, so no scope covers it
+	if len(principal.Scopes) > 0 {
+		respondWithError(w, http.StatusForbidden, "Scoped tokens can't be used here")
+		return
+	}
+	userId := principal.UserId
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	cfg.websockets.Add(1)
+	defer cfg.websockets.Done()
+
+	sub, _ := cfg.events.Subscribe(0)
+	defer sub.Unsubscribe()
+
+	topics := &websocketTopics{
+		mux:    &sync.RWMutex{},
+		userId: userId,
+		topics: map[string]struct{}{},
+	}
+	refreshMuted := func() {
+		mutedIds, err := cfg.db.GetMutedIds(userId)
+		if err == nil {
+			topics.setMuted(mutedIds)
+		}
+	}
+	refreshMuted()
+
+	replies := make(chan websocketMessage, websocketReplyBuffer)
+	readerDone := make(chan struct{})
+
+	conn.SetReadDeadline(time.Now().Add(websocketReadTimeout))
+	conn.PongHandler = func() {
+		conn.SetReadDeadline(time.Now().Add(websocketReadTimeout))
+	}
+
+	go func() {
+		defer close(readerDone)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(websocketReadTimeout))
+
+			reply := handleWebsocketCommand(topics, data)
+			select {
+			case replies <- reply:
+			default:
+				// the client sends commands faster than it reads replies
+				conn.WriteClose(websocket.ClosePolicy, "too many pending replies")
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(websocketPingInterval)
+	defer ping.Stop()
+
+	write := func(message websocketMessage) error {
+		dat, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+		return conn.WriteMessage(websocket.TextMessage, dat)
+	}
+
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				if sub.Lagged() {
+					conn.WriteClose(websocket.CloseTryAgainLater, "client too slow")
+				} else {
+					conn.WriteClose(websocket.CloseGoingAway, "server shutting down")
+				}
+				return
+			}
+			topic, ok := topics.match(event)
+			if !ok {
+				continue
+			}
+			if write(websocketMessage{Type: "event", Topic: topic, Event: &event}) != nil {
+				return
+			}
+		case reply := <-replies:
+			if write(reply) != nil {
+				return
+			}
+		case <-ping.C:
+			refreshMuted()
+			conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+			if conn.WritePing(nil) != nil {
+				return
+			}
+		case <-readerDone:
+			return
+		}
+	}
+}
+
+func handleWebsocketCommand(topics *websocketTopics, data []byte) websocketMessage {
+	command := websocketCommand{}
+	err := json.Unmarshal(data, &command)
+	if err != nil {
+		return websocketMessage{Type: "error", Message: "invalid message"}
+	}
+
+	switch command.Type {
+	case "ping":
+		return websocketMessage{Type: "pong"}
+	case "subscribe", "unsubscribe":
+		if !validTopic(command.Topic) {
+			return websocketMessage{Type: "error", Topic: command.Topic, Message: "unknown topic"}
+		}
+		subscribed := command.Type == "subscribe"
+		topics.set(command.Topic, subscribed)
+		if subscribed {
+			return websocketMessage{Type: "subscribed", Topic: command.Topic}
+		}
+		return websocketMessage{Type: "unsubscribed", Topic: command.Topic}
+	default:
+		return websocketMessage{Type: "error", Message: "unknown message type"}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+)
+
+const impressionFlushInterval = 30 * time.Second
+
+// impressionCounter buffers chirp impressions in memory so that serving
+// chirps doesn't cost a database write per read
+type impressionCounter struct {
+	mux    *sync.Mutex
+	counts map[int]int
+}
+
+func newImpressionCounter() *impressionCounter {
+	return &impressionCounter{
+		mux:    &sync.Mutex{},
+		counts: map[int]int{},
+	}
+}
+
+func (c *impressionCounter) record(chirps ...database.Chirp) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for _, chirp := range chirps {
+		c.counts[chirp.Id]++
+	}
+}
+
+// flush writes the buffered counts to the database. If the write fails the
+// counts are kept and retried on the next flush.
+func (c *impressionCounter) flush(db *database.DB) error {
+	c.mux.Lock()
+	pending := c.counts
+	c.counts = map[int]int{}
+	c.mux.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := db.RecordImpressions(pending, time.Now())
+	if err != nil {
+		c.mux.Lock()
+		for chirpId, count := range pending {
+			c.counts[chirpId] += count
+		}
+		c.mux.Unlock()
+	}
+	return err
+}
+
+// run flushes the counter on every interval until done is closed
+func (c *impressionCounter) run(db *database.DB, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.flush(db); err != nil {
+				fmt.Println("Unable to flush impressions:", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
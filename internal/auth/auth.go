@@ -1,6 +1,10 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
@@ -8,41 +12,51 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func HashPassword(password string) (string, error) {
-	dat, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-
-	if err != nil {
-		return "", err
-	}
-
-	return string(dat), nil
+// Claims are the claims in the tokens Chirpy issues
+type Claims struct {
+	jwt.RegisteredClaims
+	// session an access token was issued for, zero if it has none
+	SessionId int `json:"sid,omitempty"`
+	// space separated scopes, empty means the token can do anything the user can
+	Scope string `json:"scope,omitempty"`
+	// OAuth client the token was issued to, empty for first-party tokens
+	ClientId string `json:"client_id,omitempty"`
 }
 
-func ValidatePassword(password string, hashedPassword string) error {
-	err := bcrypt.CompareHashAndPassword(
-		[]byte(hashedPassword),
-		[]byte(password),
-	)
-	return err
+func IssueJWT(issuer string, userId int, keys *KeySet, expiresIn time.Duration) (string, error) {
+	return IssueJWTWithClaims(Claims{}, issuer, userId, keys, expiresIn)
 }
 
-func IssueJWT(issuer string, userId int, signingSecret string, expiresIn time.Duration) (string, error) {
+// IssueJWTWithClaims is IssueJWT with the session, scope and client claims copied from claims
+func IssueJWTWithClaims(claims Claims, issuer string, userId int, keys *KeySet, expiresIn time.Duration) (string, error) {
 	now := time.Now().UTC()
 	issuedTime := jwt.NewNumericDate(now)
 	expiredTime := jwt.NewNumericDate(now.Add(expiresIn))
 
+	// a random id keeps tokens issued in the same second distinct
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
-		jwt.RegisteredClaims{
-			Issuer:    issuer,
-			IssuedAt:  issuedTime,
-			ExpiresAt: expiredTime,
-			Subject:   fmt.Sprintf("%v", userId),
+		Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        base64.RawURLEncoding.EncodeToString(id),
+				Issuer:    issuer,
+				IssuedAt:  issuedTime,
+				ExpiresAt: expiredTime,
+				Subject:   fmt.Sprintf("%v", userId),
+			},
+			SessionId: claims.SessionId,
+			Scope:     claims.Scope,
+			ClientId:  claims.ClientId,
 		})
 
-	signedToken, err := token.SignedString([]byte(signingSecret))
+	signedToken, err := keys.sign(token)
 
 	if err != nil {
 		return "", errors.New("unable to sign token")
@@ -51,18 +65,22 @@ func IssueJWT(issuer string, userId int, signingSecret string, expiresIn time.Du
 	return signedToken, nil
 }
 
-func ValidateJWT(token string, signingSecret string) (jwt.Token, jwt.Claims, error) {
+func ValidateJWT(token string, keys *KeySet) (jwt.Token, Claims, error) {
 	// parse the token, ensuring it's valid
 	// claims can be parsed directly - type hinting included or off the token (no type knowledge)
-	claims := jwt.RegisteredClaims{}
+	// the key is chosen by kid and only accepted with its own algorithm
+	claims := Claims{}
 	parsedToken, err := jwt.ParseWithClaims(
 		token,
 		&claims,
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(signingSecret), nil
-		})
+		keys.verificationKey,
+		jwt.WithValidMethods([]string{
+			jwt.SigningMethodHS256.Alg(),
+			jwt.SigningMethodEdDSA.Alg(),
+			jwt.SigningMethodRS256.Alg(),
+		}))
 	if err != nil {
-		return jwt.Token{}, nil, err
+		return jwt.Token{}, Claims{}, err
 	}
 
 	return *parsedToken, claims, nil
@@ -93,3 +111,22 @@ func ParseApiKey(headers http.Header) (string, error) {
 
 	return apiKey, nil
 }
+
+// NewOpaqueToken returns a random url-safe token and the hash to store in its place
+func NewOpaqueToken() (token string, hash string, err error) {
+	dat := make([]byte, 32)
+	_, err = rand.Read(dat)
+	if err != nil {
+		return "", "", err
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(dat)
+	return token, HashToken(token), nil
+}
+
+// HashToken hashes a high entropy token for storage. Tokens are random so a
+// fast unsalted hash is enough, unlike passwords.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
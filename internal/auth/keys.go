@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/exp/slices"
+)
+
+// RSA keys smaller than this are refused
+const minRSAKeyBits = 2048
+
+// Key is one key tokens can be signed or verified with. Asymmetric keys are
+// identified by their RFC 7638 thumbprint, which is sent as the kid header.
+type Key struct {
+	Id     string
+	Method jwt.SigningMethod
+	// nil for keys that can only verify
+	private crypto.PrivateKey
+	public  crypto.PublicKey
+}
+
+// KeySet signs new tokens with one key and accepts tokens from any of its
+// keys, so old keys keep working while they are rotated out
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+	// shared secret for tokens signed before asymmetric keys were configured,
+	// these tokens have no kid
+	hmacSecret []byte
+}
+
+// NewHMACKeySet signs and verifies with a single HS256 shared secret
+func NewHMACKeySet(secret string) *KeySet {
+	return &KeySet{
+		keys:       map[string]*Key{},
+		hmacSecret: []byte(secret),
+	}
+}
+
+// LoadKeySet reads a PEM private key (Ed25519 or RSA) to sign with, plus any
+// number of PEM public or private keys that are only used to verify. A
+// non-empty hmacSecret is still accepted for tokens without a kid, pass
+// it only while tokens from before the switch may still be in use.
+func LoadKeySet(signingKeyPath string, verificationKeyPaths []string, hmacSecret string) (*KeySet, error) {
+	keySet := &KeySet{
+		keys:       map[string]*Key{},
+		hmacSecret: []byte(hmacSecret),
+	}
+
+	signing, err := loadKey(signingKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	if signing.private == nil {
+		return nil, fmt.Errorf("%s: signing key must be a private key", signingKeyPath)
+	}
+	keySet.signing = signing
+	keySet.keys[signing.Id] = signing
+
+	for _, path := range verificationKeyPaths {
+		key, err := loadKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keySet.keys[key.Id] = key
+	}
+
+	return keySet, nil
+}
+
+func loadKey(path string) (*Key, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(dat)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	key, err := newKey(parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+func newKey(parsed any) (*Key, error) {
+	key := &Key{}
+	switch k := parsed.(type) {
+	case ed25519.PrivateKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.private = k
+		key.public = k.Public()
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.public = k
+	case *rsa.PrivateKey:
+		key.Method = jwt.SigningMethodRS256
+		key.private = k
+		key.public = &k.PublicKey
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+		key.public = k
+	default:
+		return nil, errors.New("key must be Ed25519 or RSA")
+	}
+
+	if public, ok := key.public.(*rsa.PublicKey); ok && public.N.BitLen() < minRSAKeyBits {
+		return nil, fmt.Errorf("RSA keys must be at least %d bits", minRSAKeyBits)
+	}
+
+	thumbprint, err := json.Marshal(key.jwk(false))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(thumbprint)
+	key.Id = base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return key, nil
+}
+
+// JWK is a public key in RFC 7517 form
+type JWK struct {
+	Kty string `json:"kty"`
+	// Ed25519 keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	// RSA keys
+	E   string `json:"e,omitempty"`
+	N   string `json:"n,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+}
+
+// jwk describes the public half of the key. Without metadata only the
+// required members are set, in the order RFC 7638 hashes them.
+func (key *Key) jwk(metadata bool) JWK {
+	jwk := JWK{}
+	switch public := key.public.(type) {
+	case ed25519.PublicKey:
+		jwk.Crv = "Ed25519"
+		jwk.Kty = "OKP"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	case *rsa.PublicKey:
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+	}
+
+	if metadata {
+		jwk.Kid = key.Id
+		jwk.Alg = key.Method.Alg()
+		jwk.Use = "sig"
+	}
+	return jwk
+}
+
+// MarshalJSON orders the members as RFC 7638 requires for thumbprints
+func (jwk JWK) MarshalJSON() ([]byte, error) {
+	type member struct {
+		name  string
+		value string
+	}
+	members := []member{
+		{"crv", jwk.Crv}, {"e", jwk.E}, {"kty", jwk.Kty}, {"n", jwk.N}, {"x", jwk.X},
+		{"kid", jwk.Kid}, {"alg", jwk.Alg}, {"use", jwk.Use},
+	}
+
+	buf := []byte{'{'}
+	for _, m := range members {
+		if m.value == "" {
+			continue
+		}
+		if len(buf) > 1 {
+			buf = append(buf, ',')
+		}
+		name, _ := json.Marshal(m.name)
+		value, _ := json.Marshal(m.value)
+		buf = append(buf, name...)
+		buf = append(buf, ':')
+		buf = append(buf, value...)
+	}
+	return append(buf, '}'), nil
+}
+
+// JWKS lists the public keys other services can verify tokens with. Shared
+// secrets are never included.
+func (keySet *KeySet) JWKS() []JWK {
+	// the signing key first, then the rest in a stable order
+	ids := []string{}
+	for id := range keySet.keys {
+		if keySet.signing == nil || id != keySet.signing.Id {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	keys := []JWK{}
+	if keySet.signing != nil {
+		keys = append(keys, keySet.signing.jwk(true))
+	}
+	for _, id := range ids {
+		keys = append(keys, keySet.keys[id].jwk(true))
+	}
+	return keys
+}
+
+func (keySet *KeySet) sign(token *jwt.Token) (string, error) {
+	if keySet.signing == nil {
+		return token.SignedString(keySet.hmacSecret)
+	}
+
+	token.Method = keySet.signing.Method
+	token.Header["alg"] = keySet.signing.Method.Alg()
+	token.Header["kid"] = keySet.signing.Id
+	return token.SignedString(keySet.signing.private)
+}
+
+// verificationKey picks the key for a token from its kid and refuses any
+// algorithm other than the one that key is for, so a public key can never be
+// used as an HMAC secret
+func (keySet *KeySet) verificationKey(token *jwt.Token) (any, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		if len(keySet.hmacSecret) == 0 {
+			return nil, errors.New("token has no kid")
+		}
+		if token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return keySet.hmacSecret, nil
+	}
+
+	key, ok := keySet.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+	return key.public, nil
+}
@@ -0,0 +1,314 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writeKey stores a key in PEM form in the test's temporary directory
+func writeKey(t *testing.T, name string, key any) string {
+	t.Helper()
+
+	var block *pem.Block
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	case ed25519.PrivateKey:
+		dat, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: dat}
+	default:
+		dat, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PUBLIC KEY", Bytes: dat}
+	}
+
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, minRSAKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// signWith signs a token for user 1 the way an attacker or another issuer
+// might, with whatever header and key they like
+func signWith(t *testing.T, method jwt.SigningMethod, kid string, key any) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "chirpy-access",
+			Subject:   "1",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestKeySetSignAndVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    any
+		method jwt.SigningMethod
+	}{
+		{"EdDSA", newEd25519Key(t), jwt.SigningMethodEdDSA},
+		{"RS256", newRSAKey(t), jwt.SigningMethodRS256},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := LoadKeySet(writeKey(t, "signing.pem", tt.key), nil, "")
+			if err != nil {
+				t.Fatalf("LoadKeySet() error = %v", err)
+			}
+
+			signed, err := IssueJWT("chirpy-access", 1, keys, time.Hour)
+			if err != nil {
+				t.Fatalf("IssueJWT() error = %v", err)
+			}
+			token, claims, err := ValidateJWT(signed, keys)
+			if err != nil {
+				t.Fatalf("ValidateJWT() error = %v", err)
+			}
+			if token.Method.Alg() != tt.method.Alg() || token.Header["kid"] != keys.signing.Id {
+				t.Errorf("token header = %v, want alg %s and kid %s", token.Header, tt.method.Alg(), keys.signing.Id)
+			}
+			if claims.Subject != "1" || claims.Issuer != "chirpy-access" {
+				t.Errorf("ValidateJWT() claims = %+v", claims)
+			}
+		})
+	}
+}
+
+func TestKeyThumbprint(t *testing.T) {
+	// RFC 8037 appendix A, the thumbprint of the Ed25519 example key
+	seed, err := base64.RawURLEncoding.DecodeString("nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := newKey(ed25519.NewKeyFromSeed(seed))
+	if err != nil {
+		t.Fatalf("newKey() error = %v", err)
+	}
+
+	if got := key.jwk(false).X; got != "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo" {
+		t.Errorf("jwk x = %s", got)
+	}
+	if key.Id != "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k" {
+		t.Errorf("newKey() kid = %s, want the RFC 8037 thumbprint", key.Id)
+	}
+}
+
+func TestKeySetRejects(t *testing.T) {
+	edKey := newEd25519Key(t)
+	rsaKey := newRSAKey(t)
+	otherKey := newEd25519Key(t)
+
+	// signs with the Ed25519 key, also accepts the RSA key
+	keys, err := LoadKeySet(writeKey(t, "signing.pem", edKey), []string{writeKey(t, "old.pem", rsaKey.Public())}, "")
+	if err != nil {
+		t.Fatalf("LoadKeySet() error = %v", err)
+	}
+	edKid := keys.signing.Id
+	rsaKid := keys.JWKS()[1].Kid
+
+	rsaPublic, err := x509.MarshalPKIXPublicKey(rsaKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rsaPublic})
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{
+			name:    "unknown kid",
+			token:   signWith(t, jwt.SigningMethodEdDSA, "not-a-key", edKey),
+			wantErr: `unknown kid "not-a-key"`,
+		},
+		{
+			name:    "another key under a known kid",
+			token:   signWith(t, jwt.SigningMethodEdDSA, edKid, otherKey),
+			wantErr: "signature is invalid",
+		},
+		{
+			name:    "algorithm of another key",
+			token:   signWith(t, jwt.SigningMethodRS256, edKid, rsaKey),
+			wantErr: "unexpected signing method",
+		},
+		{
+			name:    "public key used as an HMAC secret",
+			token:   signWith(t, jwt.SigningMethodHS256, rsaKid, rsaPublicPEM),
+			wantErr: "unexpected signing method",
+		},
+		{
+			name:    "HMAC token without a kid",
+			token:   signWith(t, jwt.SigningMethodHS256, "", rsaPublicPEM),
+			wantErr: "token has no kid",
+		},
+		{
+			name:    "unsigned",
+			token:   signWith(t, jwt.SigningMethodNone, edKid, jwt.UnsafeAllowNoneSignatureType),
+			wantErr: "signing method none is invalid",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ValidateJWT(tt.token, keys)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateJWT() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// the RSA key is accepted with its own algorithm
+	_, _, err = ValidateJWT(signWith(t, jwt.SigningMethodRS256, rsaKid, rsaKey), keys)
+	if err != nil {
+		t.Errorf("ValidateJWT() with a verification key error = %v", err)
+	}
+}
+
+func TestKeySetLegacyHMAC(t *testing.T) {
+	legacy, err := IssueJWT("chirpy-access", 1, NewHMACKeySet("old secret"), time.Hour)
+	if err != nil {
+		t.Fatalf("IssueJWT() error = %v", err)
+	}
+	signingKey := writeKey(t, "signing.pem", newEd25519Key(t))
+
+	tests := []struct {
+		name    string
+		secret  string
+		wantErr bool
+	}{
+		{"accepted when opted in", "old secret", false},
+		{"refused by default", "", true},
+		{"refused with another secret", "new secret", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := LoadKeySet(signingKey, nil, tt.secret)
+			if err != nil {
+				t.Fatalf("LoadKeySet() error = %v", err)
+			}
+			_, _, err = ValidateJWT(legacy, keys)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateJWT() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	oldKey := newEd25519Key(t)
+	oldKeys, err := LoadKeySet(writeKey(t, "old.pem", oldKey), nil, "")
+	if err != nil {
+		t.Fatalf("LoadKeySet() error = %v", err)
+	}
+	signed, err := IssueJWT("chirpy-access", 1, oldKeys, time.Hour)
+	if err != nil {
+		t.Fatalf("IssueJWT() error = %v", err)
+	}
+
+	// the old key moves to the verification keys, its tokens keep working
+	newKeys, err := LoadKeySet(writeKey(t, "new.pem", newRSAKey(t)), []string{writeKey(t, "old.pub", oldKey.Public())}, "")
+	if err != nil {
+		t.Fatalf("LoadKeySet() error = %v", err)
+	}
+	_, _, err = ValidateJWT(signed, newKeys)
+	if err != nil {
+		t.Errorf("ValidateJWT() error = %v for a token from the rotated out key", err)
+	}
+
+	jwks := newKeys.JWKS()
+	if len(jwks) != 2 {
+		t.Fatalf("JWKS() = %v, want both keys", jwks)
+	}
+	if jwks[0].Kid != newKeys.signing.Id || jwks[0].Kty != "RSA" || jwks[0].Alg != "RS256" || jwks[0].Use != "sig" {
+		t.Errorf("JWKS()[0] = %+v, want the signing key first", jwks[0])
+	}
+	if jwks[1].Kid != oldKeys.signing.Id || jwks[1].Kty != "OKP" || jwks[1].Crv != "Ed25519" || jwks[1].Alg != "EdDSA" {
+		t.Errorf("JWKS()[1] = %+v, want the old key", jwks[1])
+	}
+
+	// shared secrets are never published
+	if keys := NewHMACKeySet("secret").JWKS(); len(keys) != 0 {
+		t.Errorf("JWKS() = %v for a shared secret", keys)
+	}
+}
+
+func TestLoadKeySetRefuses(t *testing.T) {
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notPEM := filepath.Join(t.TempDir(), "key.txt")
+	os.WriteFile(notPEM, []byte("not a key"), 0600)
+
+	tests := []struct {
+		name             string
+		signingKey       string
+		verificationKeys []string
+		wantErr          string
+	}{
+		{"public signing key", writeKey(t, "signing.pub", newEd25519Key(t).Public()), nil, "must be a private key"},
+		{"small RSA key", writeKey(t, "small.pem", smallKey), nil, "at least 2048 bits"},
+		{"not PEM", notPEM, nil, "no PEM data"},
+		{"missing verification key", writeKey(t, "signing.pem", newEd25519Key(t)), []string{notPEM + ".missing"}, "no such file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadKeySet(tt.signingKey, tt.verificationKeys, "")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadKeySet() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
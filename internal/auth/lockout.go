@@ -0,0 +1,267 @@
+package auth
+
+import (
+	"cmp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	LockoutAccount = "account"
+	LockoutIP      = "ip"
+)
+
+// LockoutPolicy describes when repeated failures start locking a key out.
+// Every failure past the threshold doubles the lockout, up to MaxLockout.
+type LockoutPolicy struct {
+	Threshold   int
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	// failures are forgotten once a key has been quiet this long
+	ResetAfter time.Duration
+}
+
+type Lockout struct {
+	Kind        string    `json:"kind"`
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// while earlier attempts are still being checked, how long to wait before
+// trying again
+const inFlightRetry = time.Second
+
+type failureRecord struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+	// attempts admitted by Begin that haven't finished yet
+	pending int
+}
+
+// LoginAttempt is a login attempt admitted by Begin. It counts against the
+// threshold until it is finished with Fail, Succeed or Release, so parallel
+// attempts can't all get in before the first failure is recorded.
+type LoginAttempt struct {
+	limiter *LoginLimiter
+	account string
+	ip      string
+	done    bool
+}
+
+// LoginLimiter tracks failed logins per account and per client IP
+type LoginLimiter struct {
+	mux           *sync.Mutex
+	accountPolicy LockoutPolicy
+	ipPolicy      LockoutPolicy
+	records       map[string]map[string]*failureRecord
+	lastPrune     time.Time
+}
+
+func NewLoginLimiter(accountPolicy LockoutPolicy, ipPolicy LockoutPolicy) *LoginLimiter {
+	return &LoginLimiter{
+		mux:           &sync.Mutex{},
+		accountPolicy: accountPolicy,
+		ipPolicy:      ipPolicy,
+		records: map[string]map[string]*failureRecord{
+			LockoutAccount: {},
+			LockoutIP:      {},
+		},
+	}
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func (l *LoginLimiter) policy(kind string) LockoutPolicy {
+	if kind == LockoutIP {
+		return l.ipPolicy
+	}
+	return l.accountPolicy
+}
+
+// Begin admits a login attempt, or returns how long the caller has to wait
+// before trying again. Attempts still in progress count as failures, the
+// check and the reservation happen under one lock.
+func (l *LoginLimiter) Begin(email string, ip string, now time.Time) (*LoginAttempt, time.Duration) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	keys := map[string]string{LockoutAccount: normalizeEmail(email), LockoutIP: ip}
+
+	wait := time.Duration(0)
+	for kind, key := range keys {
+		record := l.record(kind, key, now)
+		if record.lockedUntil.After(now) {
+			wait = max(wait, record.lockedUntil.Sub(now))
+		} else if record.pending > 0 && record.failures+record.pending >= l.policy(kind).Threshold {
+			// the attempts in flight could lock the key, wait for them.
+			// Once a lockout has run out a single attempt is let through.
+			wait = max(wait, inFlightRetry)
+		}
+	}
+	if wait > 0 {
+		return nil, wait
+	}
+
+	for kind, key := range keys {
+		l.records[kind][key].pending++
+	}
+	return &LoginAttempt{limiter: l, account: keys[LockoutAccount], ip: ip}, 0
+}
+
+// record returns the record for a key, creating it and forgetting failures
+// that are old enough to reset
+func (l *LoginLimiter) record(kind string, key string, now time.Time) *failureRecord {
+	record, ok := l.records[kind][key]
+	if !ok {
+		record = &failureRecord{}
+		l.records[kind][key] = record
+	}
+	if record.failures > 0 && now.Sub(record.lastFailure) > l.policy(kind).ResetAfter && !record.lockedUntil.After(now) {
+		record.failures = 0
+	}
+	return record
+}
+
+// Fail counts the attempt as a failure against both the account and the IP
+func (a *LoginAttempt) Fail(now time.Time) {
+	a.finish(func(l *LoginLimiter) {
+		l.recordFailure(LockoutAccount, a.account, now)
+		l.recordFailure(LockoutIP, a.ip, now)
+
+		if now.Sub(l.lastPrune) > time.Minute {
+			l.prune(now)
+			l.lastPrune = now
+		}
+	})
+}
+
+// Succeed clears the account's failures. The IP keeps its count so an
+// attacker can't reset it by logging into an account of their own.
+func (a *LoginAttempt) Succeed() {
+	a.finish(func(l *LoginLimiter) {
+		record := l.records[LockoutAccount][a.account]
+		record.failures = 0
+		record.lockedUntil = time.Time{}
+	})
+}
+
+// Release ends the attempt without counting it either way, for attempts
+// that couldn't be checked or still have another step to pass
+func (a *LoginAttempt) Release() {
+	a.finish(func(l *LoginLimiter) {})
+}
+
+func (a *LoginAttempt) finish(fn func(l *LoginLimiter)) {
+	l := a.limiter
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if a.done {
+		return
+	}
+	a.done = true
+
+	// records with attempts in progress are never removed
+	keys := map[string]string{LockoutAccount: a.account, LockoutIP: a.ip}
+	for kind, key := range keys {
+		l.records[kind][key].pending--
+	}
+	fn(l)
+	for kind, key := range keys {
+		if record := l.records[kind][key]; record.failures == 0 && record.pending == 0 {
+			delete(l.records[kind], key)
+		}
+	}
+}
+
+func (l *LoginLimiter) recordFailure(kind string, key string, now time.Time) {
+	policy := l.policy(kind)
+
+	record := l.record(kind, key, now)
+	record.failures++
+	record.lastFailure = now
+
+	if record.failures >= policy.Threshold {
+		lockout := policy.BaseLockout
+		for i := policy.Threshold; i < record.failures && lockout < policy.MaxLockout; i++ {
+			lockout *= 2
+		}
+		record.lockedUntil = now.Add(min(lockout, policy.MaxLockout))
+	}
+}
+
+// prune forgets keys that have been quiet long enough to reset
+func (l *LoginLimiter) prune(now time.Time) {
+	for kind, records := range l.records {
+		policy := l.policy(kind)
+		for key, record := range records {
+			if record.pending == 0 && now.Sub(record.lastFailure) > policy.ResetAfter && !record.lockedUntil.After(now) {
+				delete(records, key)
+			}
+		}
+	}
+}
+
+// Lockouts lists the keys that are currently locked out
+func (l *LoginLimiter) Lockouts(now time.Time) []Lockout {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	lockouts := []Lockout{}
+	for kind, records := range l.records {
+		for key, record := range records {
+			if record.lockedUntil.After(now) {
+				lockouts = append(lockouts, Lockout{
+					Kind:        kind,
+					Key:         key,
+					Failures:    record.failures,
+					LastFailure: record.lastFailure,
+					LockedUntil: record.lockedUntil,
+				})
+			}
+		}
+	}
+
+	slices.SortFunc(lockouts, func(a, b Lockout) int {
+		if c := cmp.Compare(a.Kind, b.Kind); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Key, b.Key)
+	})
+	return lockouts
+}
+
+// Clear removes a lockout and its failure history, reporting whether one existed
+func (l *LoginLimiter) Clear(kind string, key string) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if kind == LockoutAccount {
+		key = normalizeEmail(key)
+	}
+	records, ok := l.records[kind]
+	if !ok {
+		return false
+	}
+	record, ok := records[key]
+	if !ok {
+		return false
+	}
+
+	existed := record.failures > 0
+	// attempts in progress still have to finish against the record
+	if record.pending > 0 {
+		*record = failureRecord{pending: record.pending}
+	} else {
+		delete(records, key)
+	}
+	return existed
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+var testLockoutPolicy = LockoutPolicy{
+	Threshold:   3,
+	BaseLockout: 30 * time.Second,
+	MaxLockout:  2 * time.Minute,
+	ResetAfter:  time.Hour,
+}
+
+// a lenient IP policy so only the account locks in these tests
+var testIPPolicy = LockoutPolicy{
+	Threshold:   100,
+	BaseLockout: time.Minute,
+	MaxLockout:  time.Hour,
+	ResetAfter:  time.Hour,
+}
+
+// fail makes a failed attempt at now, which has to be admitted
+func fail(t *testing.T, l *LoginLimiter, now time.Time) {
+	t.Helper()
+
+	attempt, wait := l.Begin("Alice@Example.com", "192.0.2.1", now)
+	if attempt == nil {
+		t.Fatalf("Begin() at %v made the attempt wait %v", now, wait)
+	}
+	attempt.Fail(now)
+}
+
+func TestLockoutExpiresAndBacksOff(t *testing.T) {
+	l := NewLoginLimiter(testLockoutPolicy, testIPPolicy)
+	now := time.Unix(1_700_000_000, 0)
+
+	// failures under the threshold don't lock
+	fail(t, l, now)
+	fail(t, l, now)
+	if lockouts := l.Lockouts(now); len(lockouts) != 0 {
+		t.Fatalf("Lockouts() = %v before the threshold", lockouts)
+	}
+
+	// reaching it locks for the base lockout, then doubles on every failure
+	for _, want := range []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 2 * time.Minute} {
+		fail(t, l, now)
+
+		_, wait := l.Begin("alice@example.com", "192.0.2.2", now)
+		if wait != want {
+			t.Fatalf("Begin() wait = %v, want %v", wait, want)
+		}
+		lockouts := l.Lockouts(now)
+		if len(lockouts) != 1 || lockouts[0].Kind != LockoutAccount || lockouts[0].Key != "alice@example.com" {
+			t.Fatalf("Lockouts() = %v, want the account", lockouts)
+		}
+		if !lockouts[0].LockedUntil.Equal(now.Add(want)) {
+			t.Errorf("Lockouts() locked until %v, want %v", lockouts[0].LockedUntil, now.Add(want))
+		}
+
+		// once the lockout runs out an attempt is admitted again
+		now = now.Add(want)
+		if lockouts := l.Lockouts(now); len(lockouts) != 0 {
+			t.Fatalf("Lockouts() = %v after the lockout ran out", lockouts)
+		}
+	}
+
+	// a success clears the account
+	attempt, wait := l.Begin("alice@example.com", "192.0.2.1", now)
+	if attempt == nil {
+		t.Fatalf("Begin() wait = %v after the lockout ran out", wait)
+	}
+	attempt.Succeed()
+	fail(t, l, now)
+	fail(t, l, now)
+	if lockouts := l.Lockouts(now); len(lockouts) != 0 {
+		t.Errorf("Lockouts() = %v, the success should have reset the failures", lockouts)
+	}
+}
+
+func TestLockoutResetsWhenQuiet(t *testing.T) {
+	l := NewLoginLimiter(testLockoutPolicy, testIPPolicy)
+	now := time.Unix(1_700_000_000, 0)
+
+	for i := 0; i < testLockoutPolicy.Threshold; i++ {
+		fail(t, l, now)
+	}
+
+	// quiet for longer than ResetAfter, the next failure starts over
+	now = now.Add(testLockoutPolicy.ResetAfter + time.Second)
+	fail(t, l, now)
+	if lockouts := l.Lockouts(now); len(lockouts) != 0 {
+		t.Errorf("Lockouts() = %v, old failures should have been forgotten", lockouts)
+	}
+}
+
+func TestLockoutCountsAttemptsInFlight(t *testing.T) {
+	l := NewLoginLimiter(testLockoutPolicy, testIPPolicy)
+	now := time.Unix(1_700_000_000, 0)
+
+	// only as many parallel attempts as could fail before the threshold
+	var attempts []*LoginAttempt
+	for i := 0; i < testLockoutPolicy.Threshold; i++ {
+		attempt, wait := l.Begin("alice@example.com", "192.0.2.1", now)
+		if attempt == nil {
+			t.Fatalf("Begin() attempt %d waited %v", i, wait)
+		}
+		attempts = append(attempts, attempt)
+	}
+	attempt, wait := l.Begin("alice@example.com", "192.0.2.1", now)
+	if attempt != nil || wait != inFlightRetry {
+		t.Fatalf("Begin() = %v, %v, want to wait for the attempts in flight", attempt, wait)
+	}
+
+	// released attempts don't count
+	for _, attempt := range attempts {
+		attempt.Release()
+	}
+	attempt, wait = l.Begin("alice@example.com", "192.0.2.1", now)
+	if attempt == nil {
+		t.Fatalf("Begin() waited %v after the attempts were released", wait)
+	}
+	attempt.Release()
+}
+
+func TestLockoutClear(t *testing.T) {
+	l := NewLoginLimiter(testLockoutPolicy, testIPPolicy)
+	now := time.Unix(1_700_000_000, 0)
+
+	for i := 0; i < testLockoutPolicy.Threshold; i++ {
+		fail(t, l, now)
+	}
+	if !l.Clear(LockoutAccount, "ALICE@example.com") {
+		t.Fatal("Clear() found no lockout")
+	}
+	if lockouts := l.Lockouts(now); len(lockouts) != 0 {
+		t.Errorf("Lockouts() = %v after Clear()", lockouts)
+	}
+	if l.Clear(LockoutAccount, "alice@example.com") {
+		t.Error("Clear() reported a lockout twice")
+	}
+}
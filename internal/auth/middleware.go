@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// only tokens from this issuer grant access to the API
+const accessIssuer = "chirpy-access"
+
+var ErrNoCredentials = errors.New("no credentials provided")
+
+// Principal is who a request was made by
+type Principal struct {
+	UserId int
+	// empty when the token can do anything the user can
+	Scopes []string
+	// zero when the credentials aren't tied to a session
+	SessionId int
+}
+
+// HasScope reports whether the principal may use scope. Tokens without any
+// scopes, such as those from a password login, have every scope.
+func (p Principal) HasScope(scope string) bool {
+	return len(p.Scopes) == 0 || slices.Contains(p.Scopes, scope)
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying the principal
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal the middleware authenticated.
+// ok is false for anonymous requests on routes where auth is optional.
+func PrincipalFromContext(ctx context.Context) (principal Principal, ok bool) {
+	principal, ok = ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// Authenticator checks bearer tokens once per request and puts the principal
+// on the request context for handlers
+type Authenticator struct {
+	keys *KeySet
+	// opaqueTokens verifies tokens that aren't JWTs, such as personal access tokens
+	opaqueTokens func(token string) (Principal, error)
+	// activeSession fails unless the user's session is still signed in
+	activeSession func(userId int, sessionId int) error
+	// unauthorized writes the response when authentication fails
+	unauthorized func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// NewAuthenticator verifies access tokens against keys and hands any other
+// bearer token to opaqueTokens, which may be nil. Access tokens are only
+// accepted while activeSession passes for their session, so signing a
+// session out takes effect at once. unauthorized writes the 401 response so
+// it matches the rest of the API.
+func NewAuthenticator(keys *KeySet, opaqueTokens func(token string) (Principal, error), activeSession func(userId int, sessionId int) error, unauthorized func(w http.ResponseWriter, r *http.Request, err error)) *Authenticator {
+	return &Authenticator{
+		keys:          keys,
+		opaqueTokens:  opaqueTokens,
+		activeSession: activeSession,
+		unauthorized:  unauthorized,
+	}
+}
+
+// Authenticate returns the principal for the bearer token on a request
+func (a *Authenticator) Authenticate(r *http.Request) (Principal, error) {
+	if r.Header.Get("Authorization") == "" {
+		return Principal{}, ErrNoCredentials
+	}
+
+	token, err := ParseBearerToken(r.Header)
+	if err != nil {
+		return Principal{}, err
+	}
+	return a.AuthenticateToken(token)
+}
+
+// AuthenticateToken returns the principal for an access token, for callers
+// that receive the token some other way than the Authorization header
+func (a *Authenticator) AuthenticateToken(token string) (Principal, error) {
+	// JWTs always have three dot separated parts
+	if strings.Count(token, ".") != 2 {
+		if a.opaqueTokens == nil {
+			return Principal{}, errors.New("unrecognized token")
+		}
+		return a.opaqueTokens(token)
+	}
+
+	_, claims, err := ValidateJWT(token, a.keys)
+	if err != nil {
+		return Principal{}, err
+	}
+	if claims.Issuer != accessIssuer {
+		return Principal{}, errors.New("non-access token received")
+	}
+
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	if claims.SessionId == 0 {
+		return Principal{}, errors.New("access token has no session")
+	}
+	err = a.activeSession(userId, claims.SessionId)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	return Principal{
+		UserId:    userId,
+		Scopes:    strings.Fields(claims.Scope),
+		SessionId: claims.SessionId,
+	}, nil
+}
+
+// Required rejects requests without a valid access token
+func (a *Authenticator) Required(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := a.Authenticate(r)
+		if err != nil {
+			a.reject(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// Optional lets anonymous requests through, but credentials that are sent
+// must still be valid
+func (a *Authenticator) Optional(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			a.reject(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+func (a *Authenticator) reject(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="chirpy"`)
+	a.unauthorized(w, r, err)
+}
@@ -0,0 +1,277 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PasswordArgon2id = "argon2id"
+	PasswordBcrypt   = "bcrypt"
+)
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// bcrypt only looks at this many bytes of a password
+const bcryptMaxPasswordLength = 72
+
+// longer passwords are refused without hashing them, argon2id's cost grows
+// with the length of the password
+const maxPasswordLength = 1024
+
+var ErrPasswordMismatch = errors.New("password does not match")
+var ErrPasswordTooLong = errors.New("password is too long")
+
+// PasswordParams picks the algorithm new passwords are hashed with and its
+// cost. Hashes made with other parameters still verify, and are reported as
+// needing a rehash.
+type PasswordParams struct {
+	Algorithm string
+	// argon2id memory in KiB, passes over the memory, and threads
+	Argon2Memory      uint32
+	Argon2Iterations  uint32
+	Argon2Parallelism uint8
+	BcryptCost        int
+	// how many passwords are hashed at once, others wait their turn. Each
+	// argon2id hash holds Argon2Memory while it runs. Zero means one per CPU.
+	MaxConcurrent int
+}
+
+// DefaultPasswordParams follows the OWASP recommendation for argon2id
+var DefaultPasswordParams = PasswordParams{
+	Algorithm:         PasswordArgon2id,
+	Argon2Memory:      19 * 1024,
+	Argon2Iterations:  2,
+	Argon2Parallelism: 1,
+	BcryptCost:        bcrypt.DefaultCost,
+}
+
+// PasswordHasher hashes passwords in a self-describing format, so the
+// algorithm and its parameters can change without breaking stored hashes.
+// argon2id hashes use the PHC string format, $argon2id$v=19$m=..,t=..,p=..$salt$key,
+// and bcrypt hashes their usual $2a$ format.
+type PasswordHasher struct {
+	params PasswordParams
+	// a slot is held while hashing
+	slots chan struct{}
+
+	dummyOnce *sync.Once
+	dummyHash string
+}
+
+func NewPasswordHasher(params PasswordParams) (*PasswordHasher, error) {
+	switch params.Algorithm {
+	case PasswordArgon2id:
+		if params.Argon2Iterations < 1 || params.Argon2Parallelism < 1 {
+			return nil, errors.New("argon2id needs at least one iteration and one thread")
+		}
+		if params.Argon2Memory < 8*uint32(params.Argon2Parallelism) {
+			return nil, errors.New("argon2id needs at least 8 KiB of memory per thread")
+		}
+	case PasswordBcrypt:
+		if params.BcryptCost < bcrypt.MinCost || params.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm %q", params.Algorithm)
+	}
+
+	if params.MaxConcurrent < 0 {
+		return nil, errors.New("password hash concurrency can't be negative")
+	}
+	if params.MaxConcurrent == 0 {
+		params.MaxConcurrent = runtime.GOMAXPROCS(0)
+	}
+
+	return &PasswordHasher{
+		params:    params,
+		slots:     make(chan struct{}, params.MaxConcurrent),
+		dummyOnce: &sync.Once{},
+	}, nil
+}
+
+// MaxPasswordLength is the longest password Hash accepts, in bytes
+func (h *PasswordHasher) MaxPasswordLength() int {
+	if h.params.Algorithm == PasswordBcrypt {
+		return bcryptMaxPasswordLength
+	}
+	return maxPasswordLength
+}
+
+// acquire waits for a free hashing slot, the returned func gives it back
+func (h *PasswordHasher) acquire() func() {
+	h.slots <- struct{}{}
+	return func() { <-h.slots }
+}
+
+// Hash hashes a new password. Passwords longer than MaxPasswordLength are
+// refused with ErrPasswordTooLong. bcrypt can't tell apart passwords that
+// only differ after 72 bytes, so with bcrypt that is its limit rather than
+// silently cutting them short.
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	if len(password) > h.MaxPasswordLength() {
+		return "", ErrPasswordTooLong
+	}
+	defer h.acquire()()
+
+	if h.params.Algorithm == PasswordBcrypt {
+		dat, err := bcrypt.GenerateFromPassword([]byte(password), h.params.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(dat), nil
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	p := argon2Hash{
+		memory:      h.params.Argon2Memory,
+		iterations:  h.params.Argon2Iterations,
+		parallelism: h.params.Argon2Parallelism,
+		salt:        salt,
+	}
+	p.key = p.derive(password, argon2KeyLength)
+	return p.String(), nil
+}
+
+// Verify checks a password against a hash made with any supported algorithm.
+// needsRehash is true when the password matched but the hash wasn't made with
+// the current parameters and Hash will take it, the caller should then store
+// a fresh Hash.
+func (h *PasswordHasher) Verify(password string, hash string) (needsRehash bool, err error) {
+	// accounts without a password, such as those from an external login,
+	// take as long to refuse as any other
+	if hash == "" {
+		return false, h.VerifyDummy(password)
+	}
+	// passwords past the limit can no longer be set, so refuse them unhashed
+	if len(password) > maxPasswordLength {
+		return false, ErrPasswordMismatch
+	}
+	defer h.acquire()()
+
+	if strings.HasPrefix(hash, "$"+PasswordArgon2id+"$") {
+		p, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false, err
+		}
+		key := p.derive(password, uint32(len(p.key)))
+		if subtle.ConstantTimeCompare(key, p.key) != 1 {
+			return false, ErrPasswordMismatch
+		}
+
+		current := h.params.Algorithm == PasswordArgon2id &&
+			p.memory == h.params.Argon2Memory &&
+			p.iterations == h.params.Argon2Iterations &&
+			p.parallelism == h.params.Argon2Parallelism &&
+			len(p.salt) == argon2SaltLength &&
+			len(p.key) == argon2KeyLength
+		// with bcrypt configured a long password can't be hashed again
+		return !current && len(password) <= h.MaxPasswordLength(), nil
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false, errors.New("unrecognized password hash")
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, ErrPasswordMismatch
+		}
+		return false, err
+	}
+
+	// a password past bcrypt's limit only matched on its first 72 bytes. It
+	// is only let in to be moved to a hash that covers all of it, which
+	// bcrypt itself can't be.
+	if len(password) > bcryptMaxPasswordLength {
+		if h.params.Algorithm == PasswordBcrypt {
+			return false, ErrPasswordTooLong
+		}
+		return true, nil
+	}
+
+	current := h.params.Algorithm == PasswordBcrypt && cost == h.params.BcryptCost
+	return !current, nil
+}
+
+// VerifyDummy takes as long as Verify with the current parameters but always
+// fails. Use it for unknown accounts so response times don't reveal which exist.
+func (h *PasswordHasher) VerifyDummy(password string) error {
+	if len(password) > maxPasswordLength {
+		return ErrPasswordMismatch
+	}
+	h.dummyOnce.Do(func() {
+		h.dummyHash, _ = h.Hash("chirpy-dummy-password")
+	})
+	h.Verify(password, h.dummyHash)
+	return ErrPasswordMismatch
+}
+
+type argon2Hash struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func (p argon2Hash) derive(password string, keyLength uint32) []byte {
+	return argon2.IDKey([]byte(password), p.salt, p.iterations, p.memory, p.parallelism, keyLength)
+}
+
+func (p argon2Hash) String() string {
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		PasswordArgon2id, argon2.Version, p.memory, p.iterations, p.parallelism,
+		base64.RawStdEncoding.EncodeToString(p.salt),
+		base64.RawStdEncoding.EncodeToString(p.key),
+	)
+}
+
+func parseArgon2Hash(hash string) (argon2Hash, error) {
+	invalid := errors.New("invalid argon2id hash")
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != PasswordArgon2id {
+		return argon2Hash{}, invalid
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return argon2Hash{}, invalid
+	}
+
+	p := argon2Hash{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism)
+	if err != nil || p.iterations < 1 || p.parallelism < 1 {
+		return argon2Hash{}, invalid
+	}
+
+	p.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return argon2Hash{}, invalid
+	}
+	p.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(p.key) == 0 {
+		return argon2Hash{}, invalid
+	}
+
+	return p, nil
+}
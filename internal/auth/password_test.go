@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheap parameters, the tests aren't about the cost
+var testPasswordParams = PasswordParams{
+	Algorithm:         PasswordArgon2id,
+	Argon2Memory:      64,
+	Argon2Iterations:  1,
+	Argon2Parallelism: 1,
+	BcryptCost:        bcrypt.MinCost,
+}
+
+func TestPasswordLength(t *testing.T) {
+	bcryptParams := testPasswordParams
+	bcryptParams.Algorithm = PasswordBcrypt
+
+	tests := []struct {
+		name    string
+		params  PasswordParams
+		length  int
+		wantErr error
+	}{
+		{"argon2id at the limit", testPasswordParams, maxPasswordLength, nil},
+		{"argon2id past the limit", testPasswordParams, maxPasswordLength + 1, ErrPasswordTooLong},
+		{"bcrypt at its limit", bcryptParams, bcryptMaxPasswordLength, nil},
+		{"bcrypt past its limit", bcryptParams, bcryptMaxPasswordLength + 1, ErrPasswordTooLong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewPasswordHasher(tt.params)
+			if err != nil {
+				t.Fatalf("NewPasswordHasher() error = %v", err)
+			}
+
+			password := strings.Repeat("a", tt.length)
+			hash, err := h.Hash(password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Hash() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			_, err = h.Verify(password, hash)
+			if err != nil {
+				t.Errorf("Verify() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyRefusesLongPasswords(t *testing.T) {
+	h, err := NewPasswordHasher(testPasswordParams)
+	if err != nil {
+		t.Fatalf("NewPasswordHasher() error = %v", err)
+	}
+	hash, err := h.Hash("password")
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+
+	long := strings.Repeat("a", maxPasswordLength+1)
+	_, err = h.Verify(long, hash)
+	if !errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("Verify() error = %v, want %v", err, ErrPasswordMismatch)
+	}
+	err = h.VerifyDummy(long)
+	if !errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("VerifyDummy() error = %v, want %v", err, ErrPasswordMismatch)
+	}
+}
+
+func TestPasswordConcurrency(t *testing.T) {
+	params := testPasswordParams
+	params.MaxConcurrent = 1
+	h, err := NewPasswordHasher(params)
+	if err != nil {
+		t.Fatalf("NewPasswordHasher() error = %v", err)
+	}
+
+	// hold the only slot, hashing has to wait for it
+	release := h.acquire()
+	done := make(chan error)
+	go func() {
+		_, err := h.Hash("password")
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Hash() ran while every slot was taken")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Hash() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Hash() didn't run once a slot was free")
+	}
+}
+
+func TestPasswordConcurrencyDefault(t *testing.T) {
+	h, err := NewPasswordHasher(testPasswordParams)
+	if err != nil {
+		t.Fatalf("NewPasswordHasher() error = %v", err)
+	}
+	if cap(h.slots) < 1 {
+		t.Errorf("NewPasswordHasher() allows %d hashes at once", cap(h.slots))
+	}
+
+	params := testPasswordParams
+	params.MaxConcurrent = -1
+	_, err = NewPasswordHasher(params)
+	if err == nil {
+		t.Error("NewPasswordHasher() accepted a negative concurrency")
+	}
+}
+
+func TestVerifyPastBcryptLimit(t *testing.T) {
+	bcryptParams := testPasswordParams
+	bcryptParams.Algorithm = PasswordBcrypt
+	argon2, err := NewPasswordHasher(testPasswordParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHasher, err := NewPasswordHasher(bcryptParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	long := strings.Repeat("a", bcryptMaxPasswordLength) + "tail"
+	// bcrypt used to cut long passwords short, hashing only the first 72 bytes
+	legacyBcrypt, err := bcrypt.GenerateFromPassword([]byte(long[:bcryptMaxPasswordLength]), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2Hash, err := argon2.Hash(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		hasher          *PasswordHasher
+		password        string
+		hash            string
+		wantNeedsRehash bool
+		wantErr         error
+	}{
+		{"bcrypt hash, argon2id moves it to a full hash", argon2, long, string(legacyBcrypt), true, nil},
+		{"bcrypt hash, bcrypt refuses the prefix match", bcryptHasher, long, string(legacyBcrypt), false, ErrPasswordTooLong},
+		{"bcrypt hash, other passwords with the same prefix", bcryptHasher, long[:bcryptMaxPasswordLength] + "other", string(legacyBcrypt), false, ErrPasswordTooLong},
+		{"argon2id hash, bcrypt can't rehash it", bcryptHasher, long, argon2Hash, false, nil},
+		{"argon2id hash, bcrypt rehashes short passwords", bcryptHasher, "password", mustHash(t, argon2, "password"), true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			needsRehash, err := tt.hasher.Verify(tt.password, tt.hash)
+			if !errors.Is(err, tt.wantErr) || needsRehash != tt.wantNeedsRehash {
+				t.Fatalf("Verify() = %v, %v, want %v, %v", needsRehash, err, tt.wantNeedsRehash, tt.wantErr)
+			}
+			// a rehash it asks for has to work
+			if needsRehash {
+				_, err = tt.hasher.Hash(tt.password)
+				if err != nil {
+					t.Errorf("Hash() error = %v after Verify() asked for a rehash", err)
+				}
+			}
+		})
+	}
+}
+
+func mustHash(t *testing.T, h *PasswordHasher, password string) string {
+	t.Helper()
+
+	hash, err := h.Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSecretBox(t *testing.T) {
+	box, err := NewSecretBox("passphrase")
+	if err != nil {
+		t.Fatalf("NewSecretBox() error = %v", err)
+	}
+	other, err := NewSecretBox("another passphrase")
+	if err != nil {
+		t.Fatalf("NewSecretBox() error = %v", err)
+	}
+
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	sealed, err := box.Seal(secret)
+	if err != nil {
+		t.Fatalf("Seal() error = %v", err)
+	}
+	if !IsSealed(sealed) || strings.Contains(sealed, secret) {
+		t.Fatalf("Seal() = %q, want an encrypted value", sealed)
+	}
+
+	again, _ := box.Seal(secret)
+	if again == sealed {
+		t.Error("Seal() returned the same value twice, nonces must be random")
+	}
+
+	tampered := []byte(sealed)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		box     *SecretBox
+		value   string
+		want    string
+		wantErr error
+	}{
+		{"round trip", box, sealed, secret, nil},
+		{"stored before sealing", box, secret, secret, nil},
+		{"other passphrase", other, sealed, "", ErrSealedValueInvalid},
+		{"tampered", box, string(tampered), "", ErrSealedValueInvalid},
+		{"truncated", box, sealedPrefix + "AAAA", "", ErrSealedValueInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.box.Open(tt.value)
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("Open() = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
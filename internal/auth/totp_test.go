@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the SHA1 seed used by the test vectors in RFC 4226 and RFC 6238
+var rfcSecret = []byte("12345678901234567890")
+
+func TestHOTPVectors(t *testing.T) {
+	// RFC 4226 appendix D, the counter is the time step
+	want := []string{
+		"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489",
+	}
+	for counter, code := range want {
+		got := totpCode(rfcSecret, int64(counter), 6)
+		if got != code {
+			t.Errorf("totpCode(counter %d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestTOTPVectors(t *testing.T) {
+	// RFC 6238 appendix B, SHA1 rows. Chirpy only issues SHA1 secrets.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.unix), func(t *testing.T) {
+			step := tt.unix / int64(totpPeriod.Seconds())
+			got := totpCode(rfcSecret, step, 8)
+			if got != tt.code {
+				t.Errorf("totpCode() = %s, want %s", got, tt.code)
+			}
+
+			// six digit codes are the same value, truncated
+			secret := totpEncoding.EncodeToString(rfcSecret)
+			gotStep, ok := ValidateTOTP(secret, tt.code[2:], time.Unix(tt.unix, 0))
+			if !ok || gotStep != step {
+				t.Errorf("ValidateTOTP() = %d, %v, want %d, true", gotStep, ok, step)
+			}
+		})
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfcSecret)
+	// 1111111111 is in step 37037037, whose code ends 050471
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / int64(totpPeriod.Seconds())
+	previous := totpCode(rfcSecret, step-1, totpDigits)
+	next := totpCode(rfcSecret, step+1, totpDigits)
+	tooOld := totpCode(rfcSecret, step-2, totpDigits)
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", secret, "050471", step, true},
+		{"spaces are ignored", secret, "050 471", step, true},
+		{"lowercase secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "050471", step, true},
+		{"previous step for clock drift", secret, previous, step - 1, true},
+		{"next step for clock drift", secret, next, step + 1, true},
+		{"two steps old", secret, tooOld, 0, false},
+		{"wrong code", secret, "123456", 0, false},
+		{"too short", secret, "05047", 0, false},
+		{"eight digits", secret, "14050471", 0, false},
+		{"invalid secret", "not base32!", "050471", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := ValidateTOTP(tt.secret, tt.code, now)
+			if ok != tt.wantOK || gotStep != tt.wantStep {
+				t.Errorf("ValidateTOTP() = %d, %v, want %d, %v", gotStep, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := NewRecoveryCodes(3)
+	if err != nil {
+		t.Fatalf("NewRecoveryCodes() error = %v", err)
+	}
+	if len(codes) != 3 || len(hashes) != 3 {
+		t.Fatalf("NewRecoveryCodes() returned %d codes and %d hashes, want 3", len(codes), len(hashes))
+	}
+
+	for i, code := range codes {
+		if len(code) != 19 {
+			t.Errorf("code %q is not four groups of four", code)
+		}
+		// typed without dashes or in capitals it still matches
+		variants := []string{code, " " + code + " ", strings.ToUpper(code), strings.ReplaceAll(code, "-", "")}
+		for _, variant := range variants {
+			if HashRecoveryCode(variant) != hashes[i] {
+				t.Errorf("HashRecoveryCode(%q) doesn't match the stored hash", variant)
+			}
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package database
+
+import (
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// UserData is everything stored about a single user
+type UserData struct {
+	User      User        `json:"user"`
+	Chirps    []Chirp     `json:"chirps"`
+	Polls     []Poll      `json:"polls"`
+	PollVotes map[int]int `json:"poll_votes"`
+	// the user's own reactions keyed by chirp id
+	Reactions            map[int]Reaction       `json:"reactions"`
+	Impressions          map[int]map[string]int `json:"impressions"`
+	Notifications        []Notification         `json:"notifications"`
+	NotificationSettings NotificationSettings   `json:"notification_settings"`
+	Conversations        []Conversation         `json:"conversations"`
+	Messages             []Message              `json:"messages"`
+	BlockedIds           []int                  `json:"blocked_ids"`
+	MutedIds             []int                  `json:"muted_ids"`
+	Sessions             []Session              `json:"sessions"`
+	PersonalTokens       []PersonalAccessToken  `json:"personal_tokens"`
+	ExternalIdentities   []ExternalIdentity     `json:"external_identities"`
+	// apps the user registered, not the ones they authorized
+	OAuthClients []OAuthClient `json:"oauth_clients"`
+}
+
+// ExportUserData collects a user's records from one consistent snapshot
+func (db *DB) ExportUserData(userId int) (UserData, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return UserData{}, err
+	}
+
+	user, ok := dbStructure.Users[userId]
+	if !ok {
+		return UserData{}, ErrUserNotFound
+	}
+
+	data := UserData{
+		User:                 user,
+		Chirps:               []Chirp{},
+		Polls:                []Poll{},
+		PollVotes:            map[int]int{},
+		Reactions:            map[int]Reaction{},
+		Impressions:          map[int]map[string]int{},
+		Notifications:        []Notification{},
+		NotificationSettings: dbStructure.NotificationSettings[userId],
+		Conversations:        []Conversation{},
+		Messages:             []Message{},
+		BlockedIds:           relationIds(dbStructure.Blocks[userId]),
+		MutedIds:             relationIds(dbStructure.Mutes[userId]),
+		Sessions:             []Session{},
+		PersonalTokens:       []PersonalAccessToken{},
+		ExternalIdentities:   []ExternalIdentity{},
+		OAuthClients:         []OAuthClient{},
+	}
+
+	for _, chirp := range dbStructure.Chirps {
+		if chirp.AuthorId != userId {
+			continue
+		}
+		data.Chirps = append(data.Chirps, chirp)
+		if poll, ok := dbStructure.Polls[chirp.Id]; ok {
+			data.Polls = append(data.Polls, poll)
+		}
+		if impressions, ok := dbStructure.Impressions[chirp.Id]; ok {
+			data.Impressions[chirp.Id] = impressions
+		}
+	}
+	for chirpId, poll := range dbStructure.Polls {
+		if option, ok := poll.Votes[userId]; ok {
+			data.PollVotes[chirpId] = option
+		}
+	}
+	for chirpId, reactions := range dbStructure.Reactions {
+		if reaction, ok := reactions[userId]; ok {
+			data.Reactions[chirpId] = reaction
+		}
+	}
+	for _, notification := range dbStructure.Notifications {
+		if notification.UserId == userId {
+			data.Notifications = append(data.Notifications, notification)
+		}
+	}
+	for _, conversation := range dbStructure.Conversations {
+		if conversation.HasParticipant(userId) {
+			data.Conversations = append(data.Conversations, conversation)
+		}
+	}
+	for _, message := range dbStructure.Messages {
+		conversation := dbStructure.Conversations[message.ConversationId]
+		if conversation.HasParticipant(userId) {
+			data.Messages = append(data.Messages, message)
+		}
+	}
+	for _, session := range dbStructure.Sessions {
+		if session.UserId == userId {
+			data.Sessions = append(data.Sessions, session)
+		}
+	}
+	for _, token := range dbStructure.PersonalAccessTokens {
+		if token.UserId == userId {
+			data.PersonalTokens = append(data.PersonalTokens, token)
+		}
+	}
+	for _, identity := range dbStructure.ExternalIdentities {
+		if identity.UserId == userId {
+			data.ExternalIdentities = append(data.ExternalIdentities, identity)
+		}
+	}
+
+	for _, client := range dbStructure.OAuthClients {
+		if client.OwnerId == userId {
+			data.OAuthClients = append(data.OAuthClients, client)
+		}
+	}
+
+	slices.SortFunc(data.Chirps, func(a, b Chirp) int { return a.Id - b.Id })
+	slices.SortFunc(data.Polls, func(a, b Poll) int { return a.ChirpId - b.ChirpId })
+	slices.SortFunc(data.Notifications, func(a, b Notification) int { return a.Id - b.Id })
+	slices.SortFunc(data.Conversations, func(a, b Conversation) int { return a.Id - b.Id })
+	slices.SortFunc(data.Sessions, func(a, b Session) int { return a.Id - b.Id })
+	slices.SortFunc(data.PersonalTokens, func(a, b PersonalAccessToken) int { return a.Id - b.Id })
+	slices.SortFunc(data.Messages, func(a, b Message) int { return a.Id - b.Id })
+	slices.SortFunc(data.ExternalIdentities, func(a, b ExternalIdentity) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	slices.SortFunc(data.OAuthClients, func(a, b OAuthClient) int { return a.CreatedAt.Compare(b.CreatedAt) })
+
+	return data, nil
+}
+
+// ScheduleUserDeletion marks a user for deletion at the given time and
+// revokes their refresh tokens
+func (db *DB) ScheduleUserDeletion(id int, at time.Time) (User, error) {
+	return db.updateUser(id, func(user *User, dbStructure *DBStructure) error {
+		user.DeletionScheduledAt = at.UTC()
+
+		dbStructure.revokeUserSessions(id, time.Now().UTC())
+		return nil
+	})
+}
+
+func (db *DB) CancelUserDeletion(id int) (User, error) {
+	return db.updateUser(id, func(user *User, dbStructure *DBStructure) error {
+		user.DeletionScheduledAt = time.Time{}
+		return nil
+	})
+}
+
+// PurgeDeletedUsers removes every user whose deletion time has passed, along
+// with their chirps, tokens and other records. Messages they sent are kept
+// for the other participants but anonymized. The purged users are returned
+// so files stored outside the database can be removed too.
+func (db *DB) PurgeDeletedUsers(now time.Time) ([]User, error) {
+	purged := []User{}
+	err := db.update(func(dbStructure *DBStructure) error {
+		for id, user := range dbStructure.Users {
+			if user.DeletionScheduledAt == (time.Time{}) || now.Before(user.DeletionScheduledAt) {
+				continue
+			}
+			dbStructure.purgeUser(id)
+			purged = append(purged, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return purged, nil
+}
+
+func (dbStructure *DBStructure) purgeUser(userId int) {
+	delete(dbStructure.Users, userId)
+
+	for chirpId, chirp := range dbStructure.Chirps {
+		if chirp.AuthorId == userId {
+			delete(dbStructure.Chirps, chirpId)
+			delete(dbStructure.Polls, chirpId)
+			delete(dbStructure.Impressions, chirpId)
+			delete(dbStructure.Reactions, chirpId)
+			dbStructure.ChirpsDeletedAt = time.Now().UTC()
+		}
+	}
+	for chirpId, reactions := range dbStructure.Reactions {
+		delete(reactions, userId)
+		if len(reactions) == 0 {
+			delete(dbStructure.Reactions, chirpId)
+		}
+	}
+	for chirpId, poll := range dbStructure.Polls {
+		if _, ok := poll.Votes[userId]; ok {
+			delete(poll.Votes, userId)
+			dbStructure.Polls[chirpId] = poll
+		}
+	}
+
+	for hash, dat := range dbStructure.Tokens {
+		if dat.UserId == userId {
+			delete(dbStructure.Tokens, hash)
+		}
+	}
+	for id, session := range dbStructure.Sessions {
+		if session.UserId == userId {
+			delete(dbStructure.Sessions, id)
+		}
+	}
+	for id, token := range dbStructure.PersonalAccessTokens {
+		if token.UserId == userId {
+			delete(dbStructure.PersonalAccessTokens, id)
+		}
+	}
+	for id, client := range dbStructure.OAuthClients {
+		if client.OwnerId == userId {
+			dbStructure.deleteOAuthClient(id, time.Now().UTC())
+		}
+	}
+	for hash, code := range dbStructure.AuthorizationCodes {
+		if code.UserId == userId {
+			delete(dbStructure.AuthorizationCodes, hash)
+		}
+	}
+	for hash, token := range dbStructure.OneTimeTokens {
+		if token.UserId == userId {
+			delete(dbStructure.OneTimeTokens, hash)
+		}
+	}
+	for key, identity := range dbStructure.ExternalIdentities {
+		if identity.UserId == userId {
+			delete(dbStructure.ExternalIdentities, key)
+		}
+	}
+
+	for id, notification := range dbStructure.Notifications {
+		if notification.UserId == userId || notification.ActorId == userId {
+			delete(dbStructure.Notifications, id)
+		}
+	}
+	delete(dbStructure.NotificationSettings, userId)
+
+	for id, message := range dbStructure.Messages {
+		if message.SenderId == userId {
+			message.SenderId = 0
+			message.Body = ""
+			dbStructure.Messages[id] = message
+		}
+	}
+	for id, conversation := range dbStructure.Conversations {
+		if !conversation.HasParticipant(userId) {
+			continue
+		}
+		conversation.Participants = removeRelation(conversation.Participants, userId)
+		delete(conversation.LastRead, userId)
+		dbStructure.Conversations[id] = conversation
+	}
+
+	delete(dbStructure.Blocks, userId)
+	delete(dbStructure.Mutes, userId)
+	for id, blocked := range dbStructure.Blocks {
+		dbStructure.Blocks[id] = removeRelation(blocked, userId)
+	}
+	for id, muted := range dbStructure.Mutes {
+		dbStructure.Mutes[id] = removeRelation(muted, userId)
+	}
+}
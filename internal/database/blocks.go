@@ -0,0 +1,100 @@
+package database
+
+import (
+	"golang.org/x/exp/slices"
+)
+
+// relations are stored per acting user, so a muted or blocked user's own
+// records never reveal it
+
+func (db *DB) BlockUser(userId int, targetId int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[targetId]; !ok {
+			return ErrUserNotFound
+		}
+		dbStructure.Blocks[userId] = addRelation(dbStructure.Blocks[userId], targetId)
+		return nil
+	})
+}
+
+func (db *DB) UnblockUser(userId int, targetId int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		dbStructure.Blocks[userId] = removeRelation(dbStructure.Blocks[userId], targetId)
+		return nil
+	})
+}
+
+func (db *DB) MuteUser(userId int, targetId int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[targetId]; !ok {
+			return ErrUserNotFound
+		}
+		dbStructure.Mutes[userId] = addRelation(dbStructure.Mutes[userId], targetId)
+		return nil
+	})
+}
+
+func (db *DB) UnmuteUser(userId int, targetId int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		dbStructure.Mutes[userId] = removeRelation(dbStructure.Mutes[userId], targetId)
+		return nil
+	})
+}
+
+func (db *DB) GetBlockedIds(userId int) ([]int, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	return relationIds(dbStructure.Blocks[userId]), nil
+}
+
+func (db *DB) GetMutedIds(userId int) ([]int, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	return relationIds(dbStructure.Mutes[userId]), nil
+}
+
+// IsBlockedBy reports whether any of blockerIds has blocked userId
+func (db *DB) IsBlockedBy(userId int, blockerIds ...int) (bool, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return false, err
+	}
+
+	for _, blockerId := range blockerIds {
+		if slices.Contains(dbStructure.Blocks[blockerId], userId) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func addRelation(ids []int, targetId int) []int {
+	if slices.Contains(ids, targetId) {
+		return ids
+	}
+	ids = append(ids, targetId)
+	slices.Sort(ids)
+	return ids
+}
+
+func removeRelation(ids []int, targetId int) []int {
+	i := slices.Index(ids, targetId)
+	if i < 0 {
+		return ids
+	}
+	return slices.Delete(ids, i, i+1)
+}
+
+func relationIds(ids []int) []int {
+	if ids == nil {
+		return []int{}
+	}
+	return slices.Clone(ids)
+}
@@ -1,40 +1,70 @@
 package database
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
+
+var ErrChirpNotFound = errors.New("chirp not found")
 
 type Chirp struct {
 	Id       int    `json:"id"`
 	Body     string `json:"body"`
 	AuthorId int    `json:"author_id"`
+	HasPoll  bool   `json:"has_poll"`
+	// the chirp this one replies to, zero for top level chirps
+	ReplyToId int       `json:"reply_to_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
-func (db *DB) CreateChirp(body string, author_id int) (Chirp, error) {
-	// get current Structure
-	DbStructure, err := db.loadDB()
+// CreateChirp stores a new chirp, replyToId is the chirp it replies to or
+// zero. ErrChirpNotFound is returned if that chirp doesn't exist.
+func (db *DB) CreateChirp(body string, author_id int, replyToId int) (Chirp, error) {
+	var newChirp Chirp
+	err := db.update(func(dbStructure *DBStructure) error {
+		var err error
+		newChirp, err = dbStructure.createChirp(body, author_id, replyToId)
+		return err
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
 
-	// create new chirp
-	chirpId := len(DbStructure.Chirps) + 1
-	newChirp := Chirp{
-		Id:       chirpId,
-		Body:     body,
-		AuthorId: author_id,
-	}
-
-	// add it to the db
-	DbStructure.Chirps[chirpId] = newChirp
+	return newChirp, nil
+}
 
-	// dump the db (call write)
-	err = db.writeDB(DbStructure)
-	if err != nil {
-		return Chirp{}, err
+// createChirp adds a chirp, returning ErrChirpNotFound if the chirp it
+// replies to doesn't exist
+func (dbStructure *DBStructure) createChirp(body string, author_id int, replyToId int) (Chirp, error) {
+	if _, ok := dbStructure.Chirps[replyToId]; replyToId != 0 && !ok {
+		return Chirp{}, ErrChirpNotFound
 	}
 
+	chirpId := dbStructure.nextChirpId()
+	newChirp := Chirp{
+		Id:        chirpId,
+		Body:      body,
+		AuthorId:  author_id,
+		ReplyToId: replyToId,
+		CreatedAt: time.Now().UTC(),
+	}
+	dbStructure.Chirps[chirpId] = newChirp
 	return newChirp, nil
 }
 
+// nextChirpId hands out the id for a new chirp. Ids are never reused, feeds
+// and stream consumers identify chirps by id and its impressions are kept.
+func (dbStructure *DBStructure) nextChirpId() int {
+	chirpId := dbStructure.LastChirpId + 1
+	for id := range dbStructure.Chirps {
+		if id >= chirpId {
+			chirpId = id + 1
+		}
+	}
+	dbStructure.LastChirpId = chirpId
+	return chirpId
+}
+
 func (db *DB) GetChirp(chirpId int) (Chirp, error) {
 	DbStructure, err := db.loadDB()
 	if err != nil {
@@ -43,7 +73,7 @@ func (db *DB) GetChirp(chirpId int) (Chirp, error) {
 
 	Chirp, ok := DbStructure.Chirps[chirpId]
 	if !ok {
-		return Chirp, errors.New("chirp not found")
+		return Chirp, ErrChirpNotFound
 	}
 	return Chirp, nil
 }
@@ -68,17 +98,27 @@ func (db *DB) GetChirps() ([]Chirp, error) {
 }
 
 func (db *DB) DeleteChirp(chirpId int) error {
-	DbStructure, err := db.loadDB()
-	if err != nil {
-		return err
-	}
+	return db.update(func(dbStructure *DBStructure) error {
+		_, ok := dbStructure.Chirps[chirpId]
+		if !ok {
+			return ErrChirpNotFound
+		}
+
+		delete(dbStructure.Chirps, chirpId)
+		delete(dbStructure.Polls, chirpId)
+		delete(dbStructure.Impressions, chirpId)
+		delete(dbStructure.Reactions, chirpId)
+		dbStructure.ChirpsDeletedAt = time.Now().UTC()
+		return nil
+	})
+}
 
-	_, ok := DbStructure.Chirps[chirpId]
-	if !ok {
-		return errors.New("chirp not found")
+// GetChirpsDeletedAt returns when a chirp was last deleted, zero if never
+func (db *DB) GetChirpsDeletedAt() (time.Time, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return time.Time{}, err
 	}
 
-	delete(DbStructure.Chirps, chirpId)
-
-	return nil
+	return dbStructure.ChirpsDeletedAt, nil
 }
@@ -9,9 +9,44 @@ import (
 )
 
 type DBStructure struct {
-	Chirps map[int]Chirp        `json:"chirps"`
-	Users  map[int]User         `json:"users"`
-	Tokens map[string]time.Time `json:"tokens"`
+	Chirps map[int]Chirp `json:"chirps"`
+	Users  map[int]User  `json:"users"`
+	// refresh tokens keyed by their hash
+	Tokens map[string]Token `json:"tokens"`
+	Polls  map[int]Poll     `json:"polls"`
+	// highest user id handed out so far
+	LastUserId int `json:"last_user_id"`
+	// highest chirp id handed out so far
+	LastChirpId int `json:"last_chirp_id"`
+	// highest refresh token family id handed out so far
+	LastTokenFamilyId int `json:"last_token_family_id"`
+	// highest notification id handed out so far
+	LastNotificationId int `json:"last_notification_id"`
+	// highest personal access token id handed out so far
+	LastPersonalTokenId int `json:"last_personal_token_id"`
+	// when a chirp was last deleted, feeds can change without a new chirp
+	ChirpsDeletedAt time.Time `json:"chirps_deleted_at"`
+	// daily impression counts keyed by chirp id, then by day
+	Impressions map[int]map[string]int `json:"impressions"`
+	// reactions keyed by chirp id, then by the user who reacted
+	Reactions            map[int]map[int]Reaction     `json:"reactions"`
+	Notifications        map[int]Notification         `json:"notifications"`
+	NotificationSettings map[int]NotificationSettings `json:"notification_settings"`
+	Conversations        map[int]Conversation         `json:"conversations"`
+	Messages             map[int]Message              `json:"messages"`
+	// blocked and muted user ids keyed by the user who blocked or muted them
+	Blocks map[int][]int `json:"blocks"`
+	Mutes  map[int][]int `json:"mutes"`
+	// single-use tokens keyed by their hash
+	OneTimeTokens map[string]OneTimeToken `json:"one_time_tokens"`
+	Sessions      map[int]Session         `json:"sessions"`
+	// personal access tokens keyed by id
+	PersonalAccessTokens map[int]PersonalAccessToken `json:"personal_access_tokens"`
+	// third-party apps keyed by client id, and their codes keyed by hash
+	OAuthClients       map[string]OAuthClient       `json:"oauth_clients"`
+	AuthorizationCodes map[string]AuthorizationCode `json:"authorization_codes"`
+	// accounts at OpenID Connect providers keyed by issuer and subject
+	ExternalIdentities map[string]ExternalIdentity `json:"external_identities"`
 }
 
 type DB struct {
@@ -19,14 +54,69 @@ type DB struct {
 	mux  *sync.RWMutex
 }
 
+// ensureMaps initializes any collections missing from an older database file
+func (dbStructure *DBStructure) ensureMaps() {
+	if dbStructure.Chirps == nil {
+		dbStructure.Chirps = map[int]Chirp{}
+	}
+	if dbStructure.Users == nil {
+		dbStructure.Users = map[int]User{}
+	}
+	if dbStructure.Tokens == nil {
+		dbStructure.Tokens = map[string]Token{}
+	}
+	if dbStructure.Polls == nil {
+		dbStructure.Polls = map[int]Poll{}
+	}
+	if dbStructure.Impressions == nil {
+		dbStructure.Impressions = map[int]map[string]int{}
+	}
+	if dbStructure.Reactions == nil {
+		dbStructure.Reactions = map[int]map[int]Reaction{}
+	}
+	if dbStructure.Notifications == nil {
+		dbStructure.Notifications = map[int]Notification{}
+	}
+	if dbStructure.NotificationSettings == nil {
+		dbStructure.NotificationSettings = map[int]NotificationSettings{}
+	}
+	if dbStructure.Conversations == nil {
+		dbStructure.Conversations = map[int]Conversation{}
+	}
+	if dbStructure.Messages == nil {
+		dbStructure.Messages = map[int]Message{}
+	}
+	if dbStructure.Blocks == nil {
+		dbStructure.Blocks = map[int][]int{}
+	}
+	if dbStructure.Mutes == nil {
+		dbStructure.Mutes = map[int][]int{}
+	}
+	if dbStructure.OneTimeTokens == nil {
+		dbStructure.OneTimeTokens = map[string]OneTimeToken{}
+	}
+	if dbStructure.Sessions == nil {
+		dbStructure.Sessions = map[int]Session{}
+	}
+	if dbStructure.PersonalAccessTokens == nil {
+		dbStructure.PersonalAccessTokens = map[int]PersonalAccessToken{}
+	}
+	if dbStructure.OAuthClients == nil {
+		dbStructure.OAuthClients = map[string]OAuthClient{}
+	}
+	if dbStructure.AuthorizationCodes == nil {
+		dbStructure.AuthorizationCodes = map[string]AuthorizationCode{}
+	}
+	if dbStructure.ExternalIdentities == nil {
+		dbStructure.ExternalIdentities = map[string]ExternalIdentity{}
+	}
+}
+
 func (db *DB) ensureDB() error {
 	_, err := os.ReadFile(db.path)
 	if errors.Is(err, os.ErrNotExist) {
-		newDb := DBStructure{
-			Chirps: map[int]Chirp{},
-			Users:  map[int]User{},
-			Tokens: map[string]time.Time{},
-		}
+		newDb := DBStructure{}
+		newDb.ensureMaps()
 		err = db.writeDB(newDb)
 	}
 
@@ -37,6 +127,37 @@ func (db *DB) loadDB() (DBStructure, error) {
 	db.mux.RLock()
 	defer db.mux.RUnlock()
 
+	return db.readFile()
+}
+
+func (db *DB) writeDB(dbStructure DBStructure) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	return db.writeFile(dbStructure)
+}
+
+// update runs a read-modify-write cycle under a single write lock so that
+// concurrent updates cannot overwrite each other. Nothing is written if fn
+// returns an error.
+func (db *DB) update(fn func(dbStructure *DBStructure) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.readFile()
+	if err != nil {
+		return err
+	}
+
+	err = fn(&dbStructure)
+	if err != nil {
+		return err
+	}
+
+	return db.writeFile(dbStructure)
+}
+
+func (db *DB) readFile() (DBStructure, error) {
 	data, err := os.ReadFile(db.path)
 	if err != nil {
 		return DBStructure{}, err
@@ -47,20 +168,21 @@ func (db *DB) loadDB() (DBStructure, error) {
 	if err != nil {
 		return DBStructure{}, err
 	}
+	dbStructure.ensureMaps()
+	dbStructure.migrateTokenOwners()
+	dbStructure.migrateTokenHashes()
 
 	return dbStructure, nil
 }
 
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
+func (db *DB) writeFile(dbStructure DBStructure) error {
 	dat, err := json.Marshal(dbStructure)
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(db.path, dat, 0666)
+	// holds password hashes and two-factor secrets
+	err = os.WriteFile(db.path, dat, 0600)
 	if err != nil {
 		return err
 	}
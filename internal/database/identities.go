@@ -0,0 +1,81 @@
+package database
+
+import (
+	"time"
+)
+
+// ExternalIdentity links an account at an OpenID Connect provider to a user
+type ExternalIdentity struct {
+	UserId  int    `json:"user_id"`
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+	// address the provider vouched for when the identity was linked
+	Email      string    `json:"email"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// the provider's subject is only unique within its issuer
+func identityKey(issuer string, subject string) string {
+	return issuer + " " + subject
+}
+
+// SignInWithIdentity returns the user an external identity belongs to. The
+// first time an identity is seen it is linked to the user with the email
+// address the provider verified, or a new user without a password is created.
+//
+// Linking to an account whose address was never verified treats the
+// provider's verification as proof of ownership: whoever signed up without
+// verifying loses the password, two-factor setup and sessions they added.
+func (db *DB) SignInWithIdentity(issuer string, subject string, verifiedEmail string) (User, error) {
+	var user User
+	err := db.update(func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		key := identityKey(issuer, subject)
+
+		identity, ok := dbStructure.ExternalIdentities[key]
+		if ok {
+			user, ok = dbStructure.Users[identity.UserId]
+		}
+		if ok {
+			identity.LastUsedAt = now
+			dbStructure.ExternalIdentities[key] = identity
+			return nil
+		}
+
+		verifiedEmail = normalizeEmail(verifiedEmail)
+		user, ok = dbStructure.userByEmail(verifiedEmail)
+
+		switch {
+		case !ok:
+			user = User{
+				Id:            dbStructure.nextUserId(),
+				Email:         verifiedEmail,
+				EmailVerified: true,
+			}
+		case !user.EmailVerified:
+			user.EmailVerified = true
+			user.HashedPassword = ""
+			user.TOTPSecret = ""
+			user.TOTPEnabled = false
+			user.RecoveryCodes = nil
+			dbStructure.revokeUserSessions(user.Id, now)
+		}
+		dbStructure.Users[user.Id] = user
+
+		dbStructure.ExternalIdentities[key] = ExternalIdentity{
+			UserId:     user.Id,
+			Issuer:     issuer,
+			Subject:    subject,
+			Email:      verifiedEmail,
+			CreatedAt:  now,
+			LastUsedAt: now,
+		}
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
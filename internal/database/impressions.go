@@ -0,0 +1,48 @@
+package database
+
+import "time"
+
+const impressionDayLayout = "2006-01-02"
+
+// ImpressionDay formats a time as the key used for daily impression counts
+func ImpressionDay(t time.Time) string {
+	return t.UTC().Format(impressionDayLayout)
+}
+
+// RecordImpressions adds a batch of per-chirp impression counts to the given day.
+// Counts for chirps that have since been deleted are dropped.
+func (db *DB) RecordImpressions(counts map[int]int, day time.Time) error {
+	dayKey := ImpressionDay(day)
+	return db.update(func(dbStructure *DBStructure) error {
+		for chirpId, count := range counts {
+			if _, ok := dbStructure.Chirps[chirpId]; !ok {
+				continue
+			}
+
+			days, ok := dbStructure.Impressions[chirpId]
+			if !ok {
+				days = map[string]int{}
+				dbStructure.Impressions[chirpId] = days
+			}
+			days[dayKey] += count
+		}
+		return nil
+	})
+}
+
+// GetImpressions returns the daily impression counts for each of the given chirps
+func (db *DB) GetImpressions(chirpIds []int) (map[int]map[string]int, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	impressions := make(map[int]map[string]int, len(chirpIds))
+	for _, chirpId := range chirpIds {
+		if days, ok := dbStructure.Impressions[chirpId]; ok {
+			impressions[chirpId] = days
+		}
+	}
+
+	return impressions, nil
+}
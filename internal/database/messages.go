@@ -0,0 +1,264 @@
+package database
+
+import (
+	"cmp"
+	"errors"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+var ErrConversationNotFound = errors.New("conversation not found")
+var ErrNotParticipant = errors.New("user is not part of this conversation")
+
+// Conversations and messages are kept apart from chirps, they are never public
+type Conversation struct {
+	Id           int       `json:"id"`
+	Participants []int     `json:"participants"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	// id of the last message each participant has read
+	LastRead map[int]int `json:"last_read"`
+}
+
+type Message struct {
+	Id             int       `json:"id"`
+	ConversationId int       `json:"conversation_id"`
+	SenderId       int       `json:"sender_id"`
+	Body           string    `json:"body"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func (c Conversation) HasParticipant(userId int) bool {
+	return slices.Contains(c.Participants, userId)
+}
+
+// CreateConversation starts a conversation between the given users. A
+// one-to-one conversation that already exists is returned instead of
+// creating a duplicate.
+func (db *DB) CreateConversation(participants []int) (Conversation, error) {
+	participants = slices.Clone(participants)
+	slices.Sort(participants)
+	participants = slices.Compact(participants)
+
+	var conversation Conversation
+	err := db.update(func(dbStructure *DBStructure) error {
+		for _, userId := range participants {
+			if _, ok := dbStructure.Users[userId]; !ok {
+				return ErrUserNotFound
+			}
+		}
+
+		if len(participants) == 2 {
+			for _, existing := range dbStructure.Conversations {
+				if slices.Equal(existing.Participants, participants) {
+					conversation = existing
+					return nil
+				}
+			}
+		}
+
+		conversationId := 1
+		for id := range dbStructure.Conversations {
+			if id >= conversationId {
+				conversationId = id + 1
+			}
+		}
+
+		now := time.Now().UTC()
+		conversation = Conversation{
+			Id:           conversationId,
+			Participants: participants,
+			CreatedAt:    now,
+			UpdatedAt:    now,
+			LastRead:     map[int]int{},
+		}
+		dbStructure.Conversations[conversationId] = conversation
+		return nil
+	})
+	if err != nil {
+		return Conversation{}, err
+	}
+
+	return conversation, nil
+}
+
+// GetConversation returns a conversation as seen by one of its participants
+func (db *DB) GetConversation(conversationId int, userId int) (Conversation, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Conversation{}, err
+	}
+
+	conversation, ok := dbStructure.Conversations[conversationId]
+	if !ok {
+		return Conversation{}, ErrConversationNotFound
+	}
+	if !conversation.HasParticipant(userId) {
+		return Conversation{}, ErrNotParticipant
+	}
+
+	return conversation, nil
+}
+
+// GetConversations returns a user's conversations, most recently active first
+func (db *DB) GetConversations(userId int) ([]Conversation, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	conversations := []Conversation{}
+	for _, conversation := range dbStructure.Conversations {
+		if conversation.HasParticipant(userId) {
+			conversations = append(conversations, conversation)
+		}
+	}
+
+	slices.SortFunc(conversations, func(a, b Conversation) int {
+		if c := b.UpdatedAt.Compare(a.UpdatedAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.Id, a.Id)
+	})
+
+	return conversations, nil
+}
+
+// CountUnreadMessages returns, per conversation, how many messages from other
+// participants the user has not read yet
+func (db *DB) CountUnreadMessages(userId int) (map[int]int, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	unread := map[int]int{}
+	for _, message := range dbStructure.Messages {
+		if message.SenderId == userId {
+			continue
+		}
+		conversation, ok := dbStructure.Conversations[message.ConversationId]
+		if !ok || !conversation.HasParticipant(userId) {
+			continue
+		}
+		if message.Id > conversation.LastRead[userId] {
+			unread[conversation.Id]++
+		}
+	}
+
+	return unread, nil
+}
+
+// CreateMessage adds a message to a conversation. Sending a message also
+// marks everything before it as read for the sender.
+func (db *DB) CreateMessage(conversationId int, senderId int, body string) (Message, error) {
+	var newMessage Message
+	err := db.update(func(dbStructure *DBStructure) error {
+		conversation, ok := dbStructure.Conversations[conversationId]
+		if !ok {
+			return ErrConversationNotFound
+		}
+		if !conversation.HasParticipant(senderId) {
+			return ErrNotParticipant
+		}
+
+		messageId := 1
+		for id := range dbStructure.Messages {
+			if id >= messageId {
+				messageId = id + 1
+			}
+		}
+
+		newMessage = Message{
+			Id:             messageId,
+			ConversationId: conversationId,
+			SenderId:       senderId,
+			Body:           body,
+			CreatedAt:      time.Now().UTC(),
+		}
+		dbStructure.Messages[messageId] = newMessage
+
+		conversation.UpdatedAt = newMessage.CreatedAt
+		if conversation.LastRead == nil {
+			conversation.LastRead = map[int]int{}
+		}
+		conversation.LastRead[senderId] = messageId
+		dbStructure.Conversations[conversationId] = conversation
+		return nil
+	})
+	if err != nil {
+		return Message{}, err
+	}
+
+	return newMessage, nil
+}
+
+// GetMessages returns up to limit messages of a conversation, newest first,
+// starting below beforeId (0 starts from the newest)
+func (db *DB) GetMessages(conversationId int, beforeId int, limit int) ([]Message, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []Message{}
+	for _, message := range dbStructure.Messages {
+		if message.ConversationId != conversationId {
+			continue
+		}
+		if beforeId > 0 && message.Id >= beforeId {
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	slices.SortFunc(messages, func(a, b Message) int {
+		return cmp.Compare(b.Id, a.Id)
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+
+	return messages, nil
+}
+
+// MarkConversationRead records that the user has read up to messageId, or
+// the whole conversation if messageId is 0. Read receipts never move backwards.
+func (db *DB) MarkConversationRead(conversationId int, userId int, messageId int) (Conversation, error) {
+	var conversation Conversation
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		conversation, ok = dbStructure.Conversations[conversationId]
+		if !ok {
+			return ErrConversationNotFound
+		}
+		if !conversation.HasParticipant(userId) {
+			return ErrNotParticipant
+		}
+
+		latest := 0
+		for _, message := range dbStructure.Messages {
+			if message.ConversationId == conversationId && message.Id > latest {
+				latest = message.Id
+			}
+		}
+		if messageId == 0 || messageId > latest {
+			messageId = latest
+		}
+
+		if conversation.LastRead == nil {
+			conversation.LastRead = map[int]int{}
+		}
+		if messageId > conversation.LastRead[userId] {
+			conversation.LastRead[userId] = messageId
+		}
+		dbStructure.Conversations[conversationId] = conversation
+		return nil
+	})
+	if err != nil {
+		return Conversation{}, err
+	}
+
+	return conversation, nil
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"cmp"
+	"errors"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	NotificationMention  = "mention"
+	NotificationReply    = "reply"
+	NotificationReaction = "reaction"
+)
+
+var NotificationTypes = []string{
+	NotificationMention,
+	NotificationReply,
+	NotificationReaction,
+}
+
+var ErrNotificationMuted = errors.New("notification type is muted")
+
+type Notification struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"user_id"`
+	Type      string    `json:"type"`
+	ActorId   int       `json:"actor_id"`
+	ChirpId   int       `json:"chirp_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// zero until the notification has been read
+	ReadAt time.Time `json:"read_at"`
+}
+
+func (n Notification) IsRead() bool {
+	return n.ReadAt != (time.Time{})
+}
+
+type NotificationSettings struct {
+	MutedTypes []string `json:"muted_types"`
+}
+
+// CreateNotification stores a notification unless the recipient has muted its
+// type, in which case ErrNotificationMuted is returned
+func (db *DB) CreateNotification(userId int, notificationType string, actorId int, chirpId int) (Notification, error) {
+	var newNotification Notification
+	err := db.update(func(dbStructure *DBStructure) error {
+		settings := dbStructure.NotificationSettings[userId]
+		if slices.Contains(settings.MutedTypes, notificationType) {
+			return ErrNotificationMuted
+		}
+
+		notificationId := dbStructure.nextNotificationId()
+		newNotification = Notification{
+			Id:        notificationId,
+			UserId:    userId,
+			Type:      notificationType,
+			ActorId:   actorId,
+			ChirpId:   chirpId,
+			CreatedAt: time.Now().UTC(),
+		}
+		dbStructure.Notifications[notificationId] = newNotification
+		return nil
+	})
+	if err != nil {
+		return Notification{}, err
+	}
+
+	return newNotification, nil
+}
+
+// GetNotifications returns up to limit of a user's notifications, newest
+// first, starting below beforeId (0 starts from the newest)
+func (db *DB) GetNotifications(userId int, beforeId int, limit int, unreadOnly bool) ([]Notification, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	notifications := []Notification{}
+	for _, notification := range dbStructure.Notifications {
+		if notification.UserId != userId {
+			continue
+		}
+		if beforeId > 0 && notification.Id >= beforeId {
+			continue
+		}
+		if unreadOnly && notification.IsRead() {
+			continue
+		}
+		notifications = append(notifications, notification)
+	}
+
+	slices.SortFunc(notifications, func(a, b Notification) int {
+		return cmp.Compare(b.Id, a.Id)
+	})
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+	}
+
+	return notifications, nil
+}
+
+func (db *DB) CountUnreadNotifications(userId int) (int, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, notification := range dbStructure.Notifications {
+		if notification.UserId == userId && !notification.IsRead() {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// MarkNotificationsRead marks the given notifications as read, or all of the
+// user's notifications if ids is empty. Ids belonging to other users are ignored.
+func (db *DB) MarkNotificationsRead(userId int, ids []int) error {
+	now := time.Now().UTC()
+	return db.update(func(dbStructure *DBStructure) error {
+		for id, notification := range dbStructure.Notifications {
+			if notification.UserId != userId || notification.IsRead() {
+				continue
+			}
+			if len(ids) > 0 && !slices.Contains(ids, id) {
+				continue
+			}
+			notification.ReadAt = now
+			dbStructure.Notifications[id] = notification
+		}
+		return nil
+	})
+}
+
+func (db *DB) GetNotificationSettings(userId int) (NotificationSettings, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return NotificationSettings{}, err
+	}
+
+	settings, ok := dbStructure.NotificationSettings[userId]
+	if !ok || settings.MutedTypes == nil {
+		settings.MutedTypes = []string{}
+	}
+
+	return settings, nil
+}
+
+func (db *DB) UpdateNotificationSettings(userId int, settings NotificationSettings) (NotificationSettings, error) {
+	err := db.update(func(dbStructure *DBStructure) error {
+		dbStructure.NotificationSettings[userId] = settings
+		return nil
+	})
+	if err != nil {
+		return NotificationSettings{}, err
+	}
+
+	return settings, nil
+}
+
+// nextNotificationId hands out the id for a new notification. Ids are never
+// reused so clients tracking what they've seen aren't confused by a new one.
+func (dbStructure *DBStructure) nextNotificationId() int {
+	notificationId := dbStructure.LastNotificationId + 1
+	for id := range dbStructure.Notifications {
+		if id >= notificationId {
+			notificationId = id + 1
+		}
+	}
+	dbStructure.LastNotificationId = notificationId
+	return notificationId
+}
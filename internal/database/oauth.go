@@ -0,0 +1,149 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+var ErrOAuthClientNotFound = errors.New("oauth client not found")
+var ErrAuthorizationCodeInvalid = errors.New("authorization code is invalid or expired")
+
+// OAuthClient is a third-party app users can grant access to
+type OAuthClient struct {
+	Id           string   `json:"id"`
+	OwnerId      int      `json:"owner_id"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	// empty for public clients, such as mobile apps, that can't keep a secret
+	SecretHash string    `json:"secret_hash"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (client OAuthClient) Confidential() bool {
+	return client.SecretHash != ""
+}
+
+// AuthorizationCode is handed to a client after the user consents and is
+// exchanged once for tokens. Only the hash of the code is stored.
+type AuthorizationCode struct {
+	ClientId    string   `json:"client_id"`
+	UserId      int      `json:"user_id"`
+	RedirectURI string   `json:"redirect_uri"`
+	Scopes      []string `json:"scopes"`
+	// PKCE S256 challenge the client must answer when exchanging the code
+	CodeChallenge string    `json:"code_challenge"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+func (db *DB) CreateOAuthClient(client OAuthClient) (OAuthClient, error) {
+	err := db.update(func(dbStructure *DBStructure) error {
+		client.CreatedAt = time.Now().UTC()
+		dbStructure.OAuthClients[client.Id] = client
+		return nil
+	})
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	return client, nil
+}
+
+func (db *DB) GetOAuthClient(id string) (OAuthClient, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	client, ok := dbStructure.OAuthClients[id]
+	if !ok {
+		return OAuthClient{}, ErrOAuthClientNotFound
+	}
+	return client, nil
+}
+
+// GetOAuthClients returns the clients a user registered, oldest first
+func (db *DB) GetOAuthClients(ownerId int) ([]OAuthClient, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	clients := []OAuthClient{}
+	for _, client := range dbStructure.OAuthClients {
+		if client.OwnerId == ownerId {
+			clients = append(clients, client)
+		}
+	}
+
+	slices.SortFunc(clients, func(a, b OAuthClient) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return clients, nil
+}
+
+// DeleteOAuthClient removes a client and signs out every session granted to it
+func (db *DB) DeleteOAuthClient(ownerId int, id string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		client, ok := dbStructure.OAuthClients[id]
+		if !ok || client.OwnerId != ownerId {
+			return ErrOAuthClientNotFound
+		}
+
+		dbStructure.deleteOAuthClient(id, time.Now().UTC())
+		return nil
+	})
+}
+
+func (dbStructure *DBStructure) deleteOAuthClient(id string, now time.Time) {
+	delete(dbStructure.OAuthClients, id)
+
+	for sessionId, session := range dbStructure.Sessions {
+		if session.ClientId == id {
+			dbStructure.revokeSession(sessionId, now)
+		}
+	}
+	for hash, code := range dbStructure.AuthorizationCodes {
+		if code.ClientId == id {
+			delete(dbStructure.AuthorizationCodes, hash)
+		}
+	}
+}
+
+func (db *DB) CreateAuthorizationCode(hash string, code AuthorizationCode) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		now := time.Now()
+		for existingHash, existing := range dbStructure.AuthorizationCodes {
+			if now.After(existing.ExpiresAt) {
+				delete(dbStructure.AuthorizationCodes, existingHash)
+			}
+		}
+
+		code.ExpiresAt = code.ExpiresAt.UTC()
+		dbStructure.AuthorizationCodes[hash] = code
+		return nil
+	})
+}
+
+// ConsumeAuthorizationCode looks up and deletes a code in one step, so it
+// can only ever be exchanged once
+func (db *DB) ConsumeAuthorizationCode(hash string) (AuthorizationCode, error) {
+	var code AuthorizationCode
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		code, ok = dbStructure.AuthorizationCodes[hash]
+		if !ok {
+			return ErrAuthorizationCodeInvalid
+		}
+
+		delete(dbStructure.AuthorizationCodes, hash)
+		return nil
+	})
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+	if time.Now().After(code.ExpiresAt) {
+		return AuthorizationCode{}, ErrAuthorizationCodeInvalid
+	}
+
+	return code, nil
+}
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposeResetPassword = "reset_password"
+	TokenPurposeMagicLink     = "magic_link"
+)
+
+var ErrOneTimeTokenInvalid = errors.New("token is invalid or expired")
+
+// OneTimeToken is a single-use token sent to a user out of band. Only the
+// hash of the token is stored.
+type OneTimeToken struct {
+	UserId    int       `json:"user_id"`
+	Purpose   string    `json:"purpose"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreateOneTimeToken stores a token hash, replacing any earlier tokens the
+// user had for the same purpose
+func (db *DB) CreateOneTimeToken(userId int, purpose string, hash string, expiresAt time.Time) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		now := time.Now()
+		for existingHash, token := range dbStructure.OneTimeTokens {
+			if (token.UserId == userId && token.Purpose == purpose) || now.After(token.ExpiresAt) {
+				delete(dbStructure.OneTimeTokens, existingHash)
+			}
+		}
+
+		dbStructure.OneTimeTokens[hash] = OneTimeToken{
+			UserId:    userId,
+			Purpose:   purpose,
+			ExpiresAt: expiresAt.UTC(),
+		}
+		return nil
+	})
+}
+
+// ConsumeOneTimeToken looks up and deletes a token in one step, so it can
+// only ever be used once
+func (db *DB) ConsumeOneTimeToken(hash string, purpose string) (OneTimeToken, error) {
+	var token OneTimeToken
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		token, ok = dbStructure.OneTimeTokens[hash]
+		if !ok || token.Purpose != purpose {
+			return ErrOneTimeTokenInvalid
+		}
+
+		// expired tokens are deleted too, they are checked below
+		delete(dbStructure.OneTimeTokens, hash)
+		return nil
+	})
+	if err != nil {
+		return OneTimeToken{}, err
+	}
+	if time.Now().After(token.ExpiresAt) {
+		return OneTimeToken{}, ErrOneTimeTokenInvalid
+	}
+
+	return token, nil
+}
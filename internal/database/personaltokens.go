@@ -0,0 +1,141 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+var ErrPersonalTokenNotFound = errors.New("personal access token not found")
+
+// how often last use is written back, so busy scripts don't write on every request
+const personalTokenUseResolution = time.Minute
+
+// PersonalAccessToken is a long-lived token a user minted for a script or
+// bot. Only the hash of the token is stored.
+type PersonalAccessToken struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"user_id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	TokenHash string    `json:"token_hash"`
+	CreatedAt time.Time `json:"created_at"`
+	// zero if the token has never been used
+	LastUsedAt time.Time `json:"last_used_at"`
+	// zero if the token never expires
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (token PersonalAccessToken) expired(now time.Time) bool {
+	return token.ExpiresAt != (time.Time{}) && now.After(token.ExpiresAt)
+}
+
+func (db *DB) CreatePersonalAccessToken(userId int, name string, scopes []string, hash string, expiresAt time.Time) (PersonalAccessToken, error) {
+	var token PersonalAccessToken
+	err := db.update(func(dbStructure *DBStructure) error {
+		id := dbStructure.nextPersonalTokenId()
+		token = PersonalAccessToken{
+			Id:        id,
+			UserId:    userId,
+			Name:      name,
+			Scopes:    scopes,
+			TokenHash: hash,
+			CreatedAt: time.Now().UTC(),
+		}
+		if expiresAt != (time.Time{}) {
+			token.ExpiresAt = expiresAt.UTC()
+		}
+		dbStructure.PersonalAccessTokens[id] = token
+		return nil
+	})
+	if err != nil {
+		return PersonalAccessToken{}, err
+	}
+
+	return token, nil
+}
+
+// GetPersonalAccessTokens returns a user's tokens, newest first. Expired
+// tokens are included so the user can see why a script stopped working.
+func (db *DB) GetPersonalAccessTokens(userId int) ([]PersonalAccessToken, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []PersonalAccessToken{}
+	for _, token := range dbStructure.PersonalAccessTokens {
+		if token.UserId == userId {
+			tokens = append(tokens, token)
+		}
+	}
+
+	slices.SortFunc(tokens, func(a, b PersonalAccessToken) int { return b.Id - a.Id })
+	return tokens, nil
+}
+
+// UsePersonalAccessToken looks up an unexpired token by hash and records
+// that it was used
+func (db *DB) UsePersonalAccessToken(hash string) (PersonalAccessToken, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return PersonalAccessToken{}, err
+	}
+
+	now := time.Now().UTC()
+	for _, token := range dbStructure.PersonalAccessTokens {
+		if token.TokenHash != hash {
+			continue
+		}
+		if token.expired(now) {
+			return PersonalAccessToken{}, ErrPersonalTokenNotFound
+		}
+		if now.Sub(token.LastUsedAt) < personalTokenUseResolution {
+			return token, nil
+		}
+
+		err = db.update(func(dbStructure *DBStructure) error {
+			// it may have been revoked since it was read
+			current, ok := dbStructure.PersonalAccessTokens[token.Id]
+			if !ok {
+				return ErrPersonalTokenNotFound
+			}
+			current.LastUsedAt = now
+			dbStructure.PersonalAccessTokens[token.Id] = current
+			token = current
+			return nil
+		})
+		if err != nil {
+			return PersonalAccessToken{}, err
+		}
+		return token, nil
+	}
+
+	return PersonalAccessToken{}, ErrPersonalTokenNotFound
+}
+
+func (db *DB) DeletePersonalAccessToken(userId int, id int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		token, ok := dbStructure.PersonalAccessTokens[id]
+		if !ok || token.UserId != userId {
+			return ErrPersonalTokenNotFound
+		}
+
+		delete(dbStructure.PersonalAccessTokens, id)
+		return nil
+	})
+}
+
+// nextPersonalTokenId hands out the id for a new personal access token. Ids
+// are never reused, a revoked token's id must not come back as a new token.
+func (dbStructure *DBStructure) nextPersonalTokenId() int {
+	tokenId := dbStructure.LastPersonalTokenId + 1
+	for id := range dbStructure.PersonalAccessTokens {
+		if id >= tokenId {
+			tokenId = id + 1
+		}
+	}
+	dbStructure.LastPersonalTokenId = tokenId
+	return tokenId
+}
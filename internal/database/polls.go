@@ -0,0 +1,129 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrPollNotFound = errors.New("poll not found")
+var ErrPollClosed = errors.New("poll is closed")
+var ErrPollAlreadyVoted = errors.New("user has already voted")
+var ErrPollInvalidOption = errors.New("invalid poll option")
+
+type Poll struct {
+	ChirpId  int       `json:"chirp_id"`
+	Options  []string  `json:"options"`
+	ClosesAt time.Time `json:"closes_at"`
+	// votes are keyed by voter id, value is the chosen option index
+	Votes map[int]int `json:"votes"`
+}
+
+// IsClosed reports whether voting on the poll has ended
+func (p Poll) IsClosed(now time.Time) bool {
+	return !now.Before(p.ClosesAt)
+}
+
+// HasVoted reports whether the given user has cast a vote
+func (p Poll) HasVoted(userId int) bool {
+	_, ok := p.Votes[userId]
+	return ok
+}
+
+// Tally returns the number of votes for each option, in option order
+func (p Poll) Tally() []int {
+	counts := make([]int, len(p.Options))
+	for _, option := range p.Votes {
+		counts[option]++
+	}
+	return counts
+}
+
+// CreateChirpWithPoll adds a chirp and its poll together, so there is never
+// a chirp whose poll failed to save
+func (db *DB) CreateChirpWithPoll(body string, authorId int, replyToId int, options []string, closesAt time.Time) (Chirp, Poll, error) {
+	var newChirp Chirp
+	newPoll := Poll{
+		Options:  options,
+		ClosesAt: closesAt.UTC(),
+		Votes:    map[int]int{},
+	}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		var err error
+		newChirp, err = dbStructure.createChirp(body, authorId, replyToId)
+		if err != nil {
+			return err
+		}
+
+		newChirp.HasPoll = true
+		dbStructure.Chirps[newChirp.Id] = newChirp
+		newPoll.ChirpId = newChirp.Id
+		dbStructure.Polls[newChirp.Id] = newPoll
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, Poll{}, err
+	}
+
+	return newChirp, newPoll, nil
+}
+
+func (db *DB) GetPolls() (map[int]Poll, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	return dbStructure.Polls, nil
+}
+
+func (db *DB) GetPoll(chirpId int) (Poll, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Poll{}, err
+	}
+
+	poll, ok := dbStructure.Polls[chirpId]
+	if !ok {
+		return Poll{}, ErrPollNotFound
+	}
+
+	return poll, nil
+}
+
+// VotePoll records a single vote for a user. The check and the write happen
+// under one lock so a user can never vote twice.
+func (db *DB) VotePoll(chirpId int, userId int, option int) (Poll, error) {
+	var poll Poll
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		poll, ok = dbStructure.Polls[chirpId]
+		if !ok {
+			return ErrPollNotFound
+		}
+
+		if poll.IsClosed(time.Now()) {
+			return ErrPollClosed
+		}
+
+		if option < 0 || option >= len(poll.Options) {
+			return ErrPollInvalidOption
+		}
+
+		if poll.HasVoted(userId) {
+			return ErrPollAlreadyVoted
+		}
+
+		if poll.Votes == nil {
+			poll.Votes = map[int]int{}
+		}
+		poll.Votes[userId] = option
+		dbStructure.Polls[chirpId] = poll
+		return nil
+	})
+	if err != nil {
+		return Poll{}, err
+	}
+
+	return poll, nil
+}
@@ -0,0 +1,77 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrReactionNotFound = errors.New("reaction not found")
+
+type Reaction struct {
+	Kind      string    `json:"kind"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SetReaction records a user's reaction to a chirp, replacing any earlier one
+// since each user has at most one reaction per chirp. created is false when
+// an existing reaction was changed.
+func (db *DB) SetReaction(chirpId int, userId int, kind string) (reaction Reaction, created bool, err error) {
+	err = db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Chirps[chirpId]; !ok {
+			return ErrChirpNotFound
+		}
+
+		reactions, ok := dbStructure.Reactions[chirpId]
+		if !ok {
+			reactions = map[int]Reaction{}
+			dbStructure.Reactions[chirpId] = reactions
+		}
+
+		existing, ok := reactions[userId]
+		created = !ok
+		// changing the kind doesn't move the reaction to another day
+		reaction = Reaction{Kind: kind, CreatedAt: time.Now().UTC()}
+		if ok {
+			reaction.CreatedAt = existing.CreatedAt
+		}
+		reactions[userId] = reaction
+		return nil
+	})
+	if err != nil {
+		return Reaction{}, false, err
+	}
+
+	return reaction, created, nil
+}
+
+func (db *DB) DeleteReaction(chirpId int, userId int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Reactions[chirpId][userId]; !ok {
+			return ErrReactionNotFound
+		}
+
+		delete(dbStructure.Reactions[chirpId], userId)
+		if len(dbStructure.Reactions[chirpId]) == 0 {
+			delete(dbStructure.Reactions, chirpId)
+		}
+		return nil
+	})
+}
+
+// GetReactions returns the reactions to each of the given chirps keyed by
+// the user who reacted
+func (db *DB) GetReactions(chirpIds []int) (map[int]map[int]Reaction, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	reactions := make(map[int]map[int]Reaction, len(chirpIds))
+	for _, chirpId := range chirpIds {
+		if users, ok := dbStructure.Reactions[chirpId]; ok {
+			reactions[chirpId] = users
+		}
+	}
+
+	return reactions, nil
+}
@@ -0,0 +1,145 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is one signed in device. Every refresh token rotated from the same
+// login belongs to it, the session id doubles as the token family id.
+type Session struct {
+	Id         int       `json:"id"`
+	UserId     int       `json:"user_id"`
+	DeviceName string    `json:"device_name"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	// zero until the session is signed out
+	RevokedAt time.Time `json:"revoked_at"`
+	// set for sessions granted to a third-party app through OAuth, limited
+	// to the scopes the user consented to
+	ClientId string   `json:"client_id,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+}
+
+// SessionClient describes the device a session was started or last used from
+type SessionClient struct {
+	DeviceName string
+	IP         string
+	UserAgent  string
+	// only used when starting a session
+	ClientId string
+	Scopes   []string
+}
+
+// GetUserSessions returns a user's sessions that are still signed in, most
+// recently used first
+func (db *DB) GetUserSessions(userId int) ([]Session, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []Session{}
+	for _, session := range dbStructure.Sessions {
+		if session.UserId == userId && session.RevokedAt == (time.Time{}) {
+			sessions = append(sessions, session)
+		}
+	}
+
+	slices.SortFunc(sessions, func(a, b Session) int { return b.LastUsedAt.Compare(a.LastUsedAt) })
+	return sessions, nil
+}
+
+func (db *DB) GetSession(id int) (Session, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Session{}, err
+	}
+
+	session, ok := dbStructure.Sessions[id]
+	if !ok {
+		return Session{}, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+// GetTokenSession returns a refresh token and the session it belongs to
+func (db *DB) GetTokenSession(hash string) (Token, Session, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Token{}, Session{}, err
+	}
+
+	token, ok := dbStructure.Tokens[hash]
+	if !ok {
+		return Token{}, Session{}, ErrTokenNotFound
+	}
+	session, ok := dbStructure.Sessions[token.FamilyId]
+	if !ok {
+		return Token{}, Session{}, ErrSessionNotFound
+	}
+	return token, session, nil
+}
+
+// RevokeSession signs a user out of one of their sessions
+func (db *DB) RevokeSession(userId int, sessionId int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		session, ok := dbStructure.Sessions[sessionId]
+		if !ok || session.UserId != userId || session.RevokedAt != (time.Time{}) {
+			return ErrSessionNotFound
+		}
+
+		dbStructure.revokeSession(sessionId, time.Now().UTC())
+		return nil
+	})
+}
+
+// revokeSession revokes a session and every refresh token in it
+func (dbStructure *DBStructure) revokeSession(sessionId int, now time.Time) {
+	if session, ok := dbStructure.Sessions[sessionId]; ok && session.RevokedAt == (time.Time{}) {
+		session.RevokedAt = now
+		dbStructure.Sessions[sessionId] = session
+	}
+
+	for hash, dat := range dbStructure.Tokens {
+		if dat.FamilyId == sessionId && dat.RevokedAt == (time.Time{}) {
+			dat.RevokedAt = now
+			dbStructure.Tokens[hash] = dat
+		}
+	}
+}
+
+// revokeUserSessions signs a user out everywhere, including any scripts using
+// their personal access tokens and apps they were about to authorize
+func (dbStructure *DBStructure) revokeUserSessions(userId int, now time.Time) {
+	for id, token := range dbStructure.PersonalAccessTokens {
+		if token.UserId == userId {
+			delete(dbStructure.PersonalAccessTokens, id)
+		}
+	}
+	for hash, code := range dbStructure.AuthorizationCodes {
+		if code.UserId == userId {
+			delete(dbStructure.AuthorizationCodes, hash)
+		}
+	}
+
+	for id, session := range dbStructure.Sessions {
+		if session.UserId == userId && session.RevokedAt == (time.Time{}) {
+			session.RevokedAt = now
+			dbStructure.Sessions[id] = session
+		}
+	}
+
+	for hash, dat := range dbStructure.Tokens {
+		if dat.UserId == userId && dat.RevokedAt == (time.Time{}) {
+			dat.RevokedAt = now
+			dbStructure.Tokens[hash] = dat
+		}
+	}
+}
@@ -1,70 +1,270 @@
 package database
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
-	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
 var ErrTokenRevoked = errors.New("token has been revoked")
 var ErrTokenNotFound = errors.New("token not present")
+var ErrTokenReused = errors.New("token has already been rotated")
 
-func (db *DB) AddToken(token string) error {
-	// get current Structure
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return err
+// Token is a refresh token, stored under the hash of the token itself so the
+// database alone can't be used to sign in
+type Token struct {
+	UserId int `json:"user_id"`
+	// tokens rotated from the same login share a family, which is also the
+	// id of their session
+	FamilyId  int       `json:"family_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// zero until the token is exchanged for its replacement
+	RotatedAt time.Time `json:"rotated_at"`
+	// zero until the token is revoked
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// UnmarshalJSON also accepts the older format, which stored only the revocation time
+func (t *Token) UnmarshalJSON(data []byte) error {
+	revokedAt := time.Time{}
+	if json.Unmarshal(data, &revokedAt) == nil {
+		*t = Token{RevokedAt: revokedAt}
+		return nil
 	}
 
-	// add the token
-	dbStructure.Tokens[token] = time.Time{}
+	type token Token
+	return json.Unmarshal(data, (*token)(t))
+}
 
-	// dump the db (call write)
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		return err
+// migrateTokenOwners fills in the owner of tokens stored in the older format.
+// Refresh tokens are JWTs we issued, so the owner is the subject claim.
+func (dbStructure *DBStructure) migrateTokenOwners() {
+	for token, dat := range dbStructure.Tokens {
+		if dat.UserId != 0 {
+			continue
+		}
+
+		claims, ok := jwtClaims(token)
+		if !ok {
+			continue
+		}
+		userId, err := strconv.Atoi(claims.Subject)
+		if err != nil {
+			continue
+		}
+
+		dat.UserId = userId
+		dbStructure.Tokens[token] = dat
 	}
-	return nil
 }
 
-func (db *DB) CheckToken(token string) error {
-	// get current Structure
-	dbStructure, err := db.loadDB()
+type jwtPayload struct {
+	Subject  string `json:"sub"`
+	IssuedAt int64  `json:"iat"`
+}
+
+// jwtClaims reads the claims of a JWT we issued without checking the signature
+func jwtClaims(token string) (jwtPayload, bool) {
+	claims := jwtPayload{}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
-		return err
+		return claims, false
+	}
+	if json.Unmarshal(payload, &claims) != nil {
+		return claims, false
 	}
 
-	dat, ok := dbStructure.Tokens[token]
-	if !ok {
-		return ErrTokenNotFound
+	return claims, true
+}
+
+// migrateTokenHashes replaces refresh tokens stored in the clear with their
+// hashes, giving each one a session so it shows up in the user's sessions.
+// Hashes are hex encoded and raw tokens are JWTs, so the two can't be confused.
+func (dbStructure *DBStructure) migrateTokenHashes() {
+	for token, dat := range dbStructure.Tokens {
+		if !strings.Contains(token, ".") {
+			continue
+		}
+
+		if dat.FamilyId == 0 {
+			dat.FamilyId = dbStructure.nextTokenFamilyId()
+		}
+		if _, ok := dbStructure.Sessions[dat.FamilyId]; !ok && dat.UserId != 0 {
+			createdAt := time.Time{}
+			if claims, ok := jwtClaims(token); ok {
+				createdAt = time.Unix(claims.IssuedAt, 0).UTC()
+			}
+			dbStructure.Sessions[dat.FamilyId] = Session{
+				Id:         dat.FamilyId,
+				UserId:     dat.UserId,
+				DeviceName: "Unknown device",
+				CreatedAt:  createdAt,
+				LastUsedAt: createdAt,
+				RevokedAt:  dat.RevokedAt,
+			}
+		}
+
+		// same as auth.HashToken
+		sum := sha256.Sum256([]byte(token))
+		delete(dbStructure.Tokens, token)
+		dbStructure.Tokens[hex.EncodeToString(sum[:])] = dat
 	}
+}
+
+// AddToken stores the hash of the refresh token from a new login and starts
+// a session for it
+func (db *DB) AddToken(hash string, userId int, expiresAt time.Time, client SessionClient) (Session, error) {
+	var session Session
+	err := db.update(func(dbStructure *DBStructure) error {
+		dbStructure.pruneTokens()
 
-	if dat != (time.Time{}) {
-		fmt.Printf("Token revoked at %v", dat)
-		return ErrTokenRevoked
+		now := time.Now().UTC()
+		session = Session{
+			Id:         dbStructure.nextTokenFamilyId(),
+			UserId:     userId,
+			DeviceName: client.DeviceName,
+			IP:         client.IP,
+			UserAgent:  client.UserAgent,
+			CreatedAt:  now,
+			LastUsedAt: now,
+			ClientId:   client.ClientId,
+			Scopes:     client.Scopes,
+		}
+		dbStructure.Sessions[session.Id] = session
+		dbStructure.Tokens[hash] = Token{
+			UserId:    userId,
+			FamilyId:  session.Id,
+			ExpiresAt: expiresAt.UTC(),
+		}
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
 	}
 
-	return nil
+	return session, nil
 }
 
-func (db *DB) RevokeToken(token string) error {
-	// get current Structure
-	dbStructure, err := db.loadDB()
+// RotateToken exchanges a refresh token for its replacement in the same
+// session. A token can only be rotated once; presenting it again means it was
+// probably stolen, so the whole session is revoked and ErrTokenReused returned.
+// Tokens are only rotated for the OAuth client they were issued to, or with
+// an empty clientId for first-party sessions.
+func (db *DB) RotateToken(hash string, newHash string, expiresAt time.Time, clientId string, client SessionClient) (Session, error) {
+	var session Session
+	reused := false
+	err := db.update(func(dbStructure *DBStructure) error {
+		dat, ok := dbStructure.Tokens[hash]
+		if !ok {
+			return ErrTokenNotFound
+		}
+		if dbStructure.Sessions[dat.FamilyId].ClientId != clientId {
+			return ErrTokenNotFound
+		}
+		if dat.RevokedAt != (time.Time{}) {
+			return ErrTokenRevoked
+		}
+
+		now := time.Now().UTC()
+		if dat.RotatedAt != (time.Time{}) {
+			reused = true
+			dbStructure.revokeSession(dat.FamilyId, now)
+			return nil
+		}
+
+		dat.RotatedAt = now
+		dbStructure.Tokens[hash] = dat
+
+		session = dbStructure.Sessions[dat.FamilyId]
+		session.LastUsedAt = now
+		session.IP = client.IP
+		session.UserAgent = client.UserAgent
+		dbStructure.Sessions[dat.FamilyId] = session
+
+		dbStructure.pruneTokens()
+		dbStructure.Tokens[newHash] = Token{
+			UserId:    dat.UserId,
+			FamilyId:  dat.FamilyId,
+			ExpiresAt: expiresAt.UTC(),
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return Session{}, err
 	}
+	if reused {
+		return Session{}, ErrTokenReused
+	}
+
+	return session, nil
+}
+
+// RevokeToken ends the session a refresh token belongs to, so tokens rotated
+// before or after it stop working too
+func (db *DB) RevokeToken(hash string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		dat, ok := dbStructure.Tokens[hash]
+		if !ok {
+			return ErrTokenNotFound
+		}
 
-	_, ok := dbStructure.Tokens[token]
-	if !ok {
-		return ErrTokenNotFound
+		dbStructure.revokeSession(dat.FamilyId, time.Now().UTC())
+		return nil
+	})
+}
+
+// RevokeUserTokens revokes every refresh token issued to a user
+func (db *DB) RevokeUserTokens(userId int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		dbStructure.revokeUserSessions(userId, time.Now().UTC())
+		return nil
+	})
+}
+
+// nextTokenFamilyId never reuses an id, even once a family's tokens are pruned
+func (dbStructure *DBStructure) nextTokenFamilyId() int {
+	familyId := dbStructure.LastTokenFamilyId + 1
+	for _, dat := range dbStructure.Tokens {
+		if dat.FamilyId >= familyId {
+			familyId = dat.FamilyId + 1
+		}
 	}
+	for id := range dbStructure.Sessions {
+		if id >= familyId {
+			familyId = id + 1
+		}
+	}
+	dbStructure.LastTokenFamilyId = familyId
+	return familyId
+}
 
-	dbStructure.Tokens[token] = time.Now()
+// pruneTokens drops tokens that have expired, they would be rejected anyway.
+// Rotated tokens are kept until then so reuse can still be detected. Sessions
+// are dropped along with their last token.
+func (dbStructure *DBStructure) pruneTokens() {
+	now := time.Now()
+	live := map[int]bool{}
+	for hash, dat := range dbStructure.Tokens {
+		if dat.ExpiresAt != (time.Time{}) && now.After(dat.ExpiresAt) {
+			delete(dbStructure.Tokens, hash)
+			continue
+		}
+		live[dat.FamilyId] = true
+	}
 
-	// dump the db (call write)
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		return err
+	for id := range dbStructure.Sessions {
+		if !live[id] {
+			delete(dbStructure.Sessions, id)
+		}
 	}
-	return nil
 }
@@ -0,0 +1,95 @@
+package database
+
+import (
+	"errors"
+
+	"golang.org/x/exp/slices"
+)
+
+var ErrTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+var ErrTOTPNotEnrolled = errors.New("two-factor authentication has not been set up")
+var ErrTOTPCodeReused = errors.New("code has already been used")
+var ErrRecoveryCodeInvalid = errors.New("recovery code is invalid")
+
+// UpdateTOTPSecrets passes every stored TOTP secret through fn, used to
+// encrypt secrets stored before they were sealed
+func (db *DB) UpdateTOTPSecrets(fn func(secret string) (string, error)) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		for id, user := range dbStructure.Users {
+			if user.TOTPSecret == "" {
+				continue
+			}
+			secret, err := fn(user.TOTPSecret)
+			if err != nil {
+				return err
+			}
+			user.TOTPSecret = secret
+			dbStructure.Users[id] = user
+		}
+		return nil
+	})
+}
+
+// BeginTOTPEnrollment stores a new secret, sealed by the caller, that isn't
+// used for login until it is confirmed
+func (db *DB) BeginTOTPEnrollment(id int, secret string) (User, error) {
+	return db.updateUser(id, func(user *User, dbStructure *DBStructure) error {
+		if user.TOTPEnabled {
+			return ErrTOTPAlreadyEnabled
+		}
+		user.TOTPSecret = secret
+		user.TOTPLastStep = 0
+		return nil
+	})
+}
+
+// EnableTOTP turns on two-factor login once the user has proven their
+// authenticator works, replacing any old recovery codes
+func (db *DB) EnableTOTP(id int, step int64, recoveryCodeHashes []string) (User, error) {
+	return db.updateUser(id, func(user *User, dbStructure *DBStructure) error {
+		if user.TOTPEnabled {
+			return ErrTOTPAlreadyEnabled
+		}
+		if user.TOTPSecret == "" {
+			return ErrTOTPNotEnrolled
+		}
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		user.RecoveryCodes = recoveryCodeHashes
+		return nil
+	})
+}
+
+func (db *DB) DisableTOTP(id int) (User, error) {
+	return db.updateUser(id, func(user *User, dbStructure *DBStructure) error {
+		user.TOTPEnabled = false
+		user.TOTPSecret = ""
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		return nil
+	})
+}
+
+// UseTOTPStep records the time step of an accepted code. Each step can only
+// be used once, so an intercepted code can't be replayed.
+func (db *DB) UseTOTPStep(id int, step int64) (User, error) {
+	return db.updateUser(id, func(user *User, dbStructure *DBStructure) error {
+		if step <= user.TOTPLastStep {
+			return ErrTOTPCodeReused
+		}
+		user.TOTPLastStep = step
+		return nil
+	})
+}
+
+// UseRecoveryCode consumes one of the user's recovery codes
+func (db *DB) UseRecoveryCode(id int, hash string) (User, error) {
+	return db.updateUser(id, func(user *User, dbStructure *DBStructure) error {
+		i := slices.Index(user.RecoveryCodes, hash)
+		if i == -1 {
+			return ErrRecoveryCodeInvalid
+		}
+		user.RecoveryCodes = slices.Delete(user.RecoveryCodes, i, i+1)
+		return nil
+	})
+}
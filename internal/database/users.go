@@ -2,45 +2,60 @@ package database
 
 import (
 	"errors"
+	"strings"
+	"time"
 )
 
 var ErrUserNotFound = errors.New("User not found")
 var ErrUserAlreadyExists = errors.New("User already exists")
+var ErrHandleTaken = errors.New("Handle already taken")
 
 type User struct {
 	Id             int    `json:"id"`
 	Email          string `json:"email"`
 	HashedPassword string `json:"password"`
 	IsRed          bool   `json:"is_chirpy_red"`
+	EmailVerified  bool   `json:"email_verified"`
+	Handle         string `json:"handle"`
+	DisplayName    string `json:"display_name"`
+	Bio            string `json:"bio"`
+	// relative to the file server root, empty when no avatar was uploaded
+	AvatarPath string `json:"avatar_path"`
+	// zero unless the user asked for their account to be deleted
+	DeletionScheduledAt time.Time `json:"deletion_scheduled_at"`
+	// set while enrolling as well, TOTPEnabled is only true once confirmed.
+	// Encrypted with the server's TOTP key, see auth.SecretBox.
+	TOTPSecret  string `json:"totp_secret"`
+	TOTPEnabled bool   `json:"totp_enabled"`
+	// last time step a code was accepted for, earlier codes are replays
+	TOTPLastStep int64 `json:"totp_last_step"`
+	// hashes of the unused recovery codes
+	RecoveryCodes []string `json:"recovery_codes"`
 }
 
-func (db *DB) CreateUser(email string, hashedPassword string) (User, error) {
-	// see if user exists
-	if _, err := db.GetUserByEmail(email); !errors.Is(err, ErrUserNotFound) {
-		// we could get ErrUserNotFound but that's okay, but return other errors
-		// either a user exists or other error ocurred
-		return User{}, ErrUserAlreadyExists
-	}
-
-	// get current Structure
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
+// normalizeEmail is the form addresses are stored and compared in. Mail
+// providers treat addresses case-insensitively, so users do too.
+func normalizeEmail(email string) string {
+	return strings.ToLower(email)
+}
 
-	// create new user
-	userId := len(dbStructure.Users) + 1
-	newUser := User{
-		Id:             userId,
-		Email:          email,
-		HashedPassword: hashedPassword,
-	}
+func (db *DB) CreateUser(email string, hashedPassword string) (User, error) {
+	email = normalizeEmail(email)
 
-	// add it to the db
-	dbStructure.Users[userId] = newUser
+	var newUser User
+	err := db.update(func(dbStructure *DBStructure) error {
+		if dbStructure.emailTaken(email, 0) {
+			return ErrUserAlreadyExists
+		}
 
-	// dump the db (call write)
-	err = db.writeDB(dbStructure)
+		newUser = User{
+			Id:             dbStructure.nextUserId(),
+			Email:          email,
+			HashedPassword: hashedPassword,
+		}
+		dbStructure.Users[newUser.Id] = newUser
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -48,62 +63,173 @@ func (db *DB) CreateUser(email string, hashedPassword string) (User, error) {
 	return newUser, nil
 }
 
-func (db *DB) UpdateUser(id int, email string, hashedPassword string) (User, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
+// nextUserId hands out the id for a new user. Ids are never reused, a
+// deleted user's old tokens must not match a new account.
+func (dbStructure *DBStructure) nextUserId() int {
+	userId := dbStructure.LastUserId + 1
+	for id := range dbStructure.Users {
+		if id >= userId {
+			userId = id + 1
+		}
 	}
+	dbStructure.LastUserId = userId
+	return userId
+}
 
-	updatedUser := User{
-		Id:             id,
-		Email:          email,
-		HashedPassword: hashedPassword,
+// emailTaken reports whether a user other than exceptId has the address,
+// in any case. Addresses are unique, users are looked up by email to sign in.
+func (dbStructure *DBStructure) emailTaken(email string, exceptId int) bool {
+	for _, user := range dbStructure.Users {
+		if user.Id != exceptId && strings.EqualFold(user.Email, email) {
+			return true
+		}
 	}
+	return false
+}
 
-	dbStructure.Users[id] = updatedUser
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		return User{}, err
+// userByEmail finds the user with an address, ignoring case. Accounts made
+// before addresses were normalized may differ only in case, an exact match
+// and then the oldest account wins so the lookup is always the same.
+func (dbStructure *DBStructure) userByEmail(email string) (User, bool) {
+	found := User{}
+	for _, user := range dbStructure.Users {
+		if user.Email == email {
+			return user, true
+		}
+		if strings.EqualFold(user.Email, email) && (found.Id == 0 || user.Id < found.Id) {
+			found = user
+		}
 	}
+	return found, found.Id != 0
+}
 
-	return updatedUser, nil
+// UpdateUser changes a user's email and password, returning
+// ErrUserAlreadyExists if another user has the new address
+func (db *DB) UpdateUser(id int, email string, hashedPassword string) (User, error) {
+	email = normalizeEmail(email)
+	return db.updateUser(id, func(user *User, dbStructure *DBStructure) error {
+		if dbStructure.emailTaken(email, id) {
+			return ErrUserAlreadyExists
+		}
+
+		// a new address has to be verified again
+		if !strings.EqualFold(user.Email, email) {
+			user.EmailVerified = false
+		}
+		user.Email = email
+		user.HashedPassword = hashedPassword
+		return nil
+	})
+}
+
+func (db *DB) SetPassword(id int, hashedPassword string) (User, error) {
+	return db.updateUser(id, func(user *User, dbStructure *DBStructure) error {
+		user.HashedPassword = hashedPassword
+		return nil
+	})
+}
+
+// RehashPassword swaps in a hash of the same password made with newer
+// parameters. It does nothing if the password changed since oldHash was read.
+func (db *DB) RehashPassword(id int, oldHash string, newHash string) error {
+	_, err := db.updateUser(id, func(user *User, dbStructure *DBStructure) error {
+		if user.HashedPassword == oldHash {
+			user.HashedPassword = newHash
+		}
+		return nil
+	})
+	return err
+}
+
+func (db *DB) VerifyEmail(id int) (User, error) {
+	return db.updateUser(id, func(user *User, dbStructure *DBStructure) error {
+		user.EmailVerified = true
+		return nil
+	})
 }
 
 func (db *DB) UpgradeUser(id int) (User, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
+	return db.updateUser(id, func(user *User, dbStructure *DBStructure) error {
+		user.IsRed = true
+		return nil
+	})
+}
+
+// UpdateProfile sets a user's public profile. Handles are unique and compared
+// case-insensitively; an empty handle leaves the user without one.
+func (db *DB) UpdateProfile(id int, handle string, displayName string, bio string) (User, error) {
+	handle = strings.ToLower(handle)
+	return db.updateUser(id, func(user *User, dbStructure *DBStructure) error {
+		if handle != "" {
+			for _, other := range dbStructure.Users {
+				if other.Id != id && other.Handle == handle {
+					return ErrHandleTaken
+				}
+			}
+		}
+
+		user.Handle = handle
+		user.DisplayName = displayName
+		user.Bio = bio
+		return nil
+	})
+}
 
-	user, err := db.GetUserById(id)
+func (db *DB) SetAvatar(id int, avatarPath string) (User, error) {
+	return db.updateUser(id, func(user *User, dbStructure *DBStructure) error {
+		user.AvatarPath = avatarPath
+		return nil
+	})
+}
+
+// updateUser applies fn to an existing user, keeping any fields fn doesn't touch
+func (db *DB) updateUser(id int, fn func(user *User, dbStructure *DBStructure) error) (User, error) {
+	var user User
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = dbStructure.Users[id]
+		if !ok {
+			return ErrUserNotFound
+		}
+
+		err := fn(&user, dbStructure)
+		if err != nil {
+			return err
+		}
+
+		dbStructure.Users[id] = user
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	updatedUser := User{
-		Id:             user.Id,
-		Email:          user.Email,
-		HashedPassword: user.HashedPassword,
-		IsRed:          true,
-	}
+	return user, nil
+}
 
-	dbStructure.Users[id] = updatedUser
-	err = db.writeDB(dbStructure)
+func (db *DB) GetUserByEmail(email string) (User, error) {
+	dbStructure, err := db.loadDB()
 	if err != nil {
 		return User{}, err
 	}
 
-	return updatedUser, nil
+	user, ok := dbStructure.userByEmail(email)
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+
+	return user, nil
 }
 
-func (db *DB) GetUserByEmail(email string) (User, error) {
+func (db *DB) GetUserByHandle(handle string) (User, error) {
 	dbStructure, err := db.loadDB()
 	if err != nil {
 		return User{}, err
 	}
 
+	handle = strings.ToLower(handle)
 	for _, user := range dbStructure.Users {
-		if user.Email == email {
+		if user.Handle != "" && user.Handle == handle {
 			return user, nil
 		}
 	}
@@ -111,6 +237,23 @@ func (db *DB) GetUserByEmail(email string) (User, error) {
 	return User{}, ErrUserNotFound
 }
 
+// GetUsersById returns the users with the given ids, missing ids are skipped
+func (db *DB) GetUsersById(ids []int) (map[int]User, error) {
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[int]User, len(ids))
+	for _, id := range ids {
+		if user, ok := dbStructure.Users[id]; ok {
+			users[id] = user
+		}
+	}
+
+	return users, nil
+}
+
 func (db *DB) GetUserById(id int) (User, error) {
 	dbStructure, err := db.loadDB()
 	if err != nil {
@@ -0,0 +1,176 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	ChirpCreated        = "chirp.created"
+	ChirpDeleted        = "chirp.deleted"
+	NotificationCreated = "notification.created"
+	MessageCreated      = "message.created"
+)
+
+// number of published events kept around for resuming subscribers
+const historySize = 256
+
+// number of events a subscriber may fall behind before it is dropped
+const subscriberBuffer = 64
+
+type Event struct {
+	Id       int64  `json:"id"`
+	Type     string `json:"type"`
+	AuthorId int    `json:"author_id,omitempty"`
+	// set for events meant for a single user, such as notifications
+	RecipientId int         `json:"-"`
+	Data        interface{} `json:"data"`
+}
+
+// Hub is an in-process publish/subscribe hub. Publishing never blocks: a
+// subscriber that can't keep up is dropped and has to resubscribe, resuming
+// from the last event it saw.
+type Hub struct {
+	mux         *sync.Mutex
+	nextId      int64
+	history     []Event
+	subscribers map[*Subscription]struct{}
+	closed      bool
+}
+
+type Subscription struct {
+	// Events is closed when the subscriber is dropped or the hub shuts down
+	Events <-chan Event
+	events chan Event
+	hub    *Hub
+	lagged bool
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		mux: &sync.Mutex{},
+		// ids start from the boot time so they keep growing across restarts and
+		// a client resuming with an id from before one doesn't skip new events.
+		// microseconds stay below 2^53 so javascript reads them exactly.
+		nextId:      time.Now().UnixMicro(),
+		history:     []Event{},
+		subscribers: map[*Subscription]struct{}{},
+	}
+}
+
+// Publish assigns the event the next id and delivers it to every subscriber
+func (h *Hub) Publish(eventType string, authorId int, data interface{}) Event {
+	return h.publish(Event{
+		Type:     eventType,
+		AuthorId: authorId,
+		Data:     data,
+	})
+}
+
+// PublishTo publishes an event addressed to a single user. Subscribers are
+// responsible for only forwarding it to that user.
+func (h *Hub) PublishTo(eventType string, recipientId int, data interface{}) Event {
+	return h.publish(Event{
+		Type:        eventType,
+		RecipientId: recipientId,
+		Data:        data,
+	})
+}
+
+func (h *Hub) publish(event Event) Event {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	event.Id = h.nextId
+	if h.closed {
+		return event
+	}
+	h.nextId++
+
+	h.history = append(h.history, event)
+	if len(h.history) > historySize {
+		h.history = h.history[len(h.history)-historySize:]
+	}
+
+	for sub := range h.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			sub.lagged = true
+			h.remove(sub)
+		}
+	}
+
+	return event
+}
+
+// Subscribe registers a new subscriber. Any retained events published after
+// lastEventId are returned so the caller can replay them before reading from
+// the subscription; pass 0 to only receive new events.
+func (h *Hub) Subscribe(lastEventId int64) (*Subscription, []Event) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	events := make(chan Event, subscriberBuffer)
+	sub := &Subscription{
+		Events: events,
+		events: events,
+		hub:    h,
+	}
+	if h.closed {
+		close(events)
+		return sub, nil
+	}
+	h.subscribers[sub] = struct{}{}
+
+	missed := []Event{}
+	if lastEventId >= h.nextId {
+		// an id this hub never handed out, from a boot with a clock ahead of
+		// ours. everything retained is new to the caller.
+		missed = append(missed, h.history...)
+	} else if lastEventId > 0 {
+		for _, event := range h.history {
+			if event.Id > lastEventId {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	return sub, missed
+}
+
+// Unsubscribe stops delivery to the subscription. It is safe to call more than once.
+func (s *Subscription) Unsubscribe() {
+	s.hub.mux.Lock()
+	defer s.hub.mux.Unlock()
+
+	s.hub.remove(s)
+}
+
+// Lagged reports whether the subscription was dropped for falling behind
+func (s *Subscription) Lagged() bool {
+	s.hub.mux.Lock()
+	defer s.hub.mux.Unlock()
+
+	return s.lagged
+}
+
+// Close ends every subscription; later publishes are discarded
+func (h *Hub) Close() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.closed = true
+	for sub := range h.subscribers {
+		h.remove(sub)
+	}
+}
+
+// remove must be called with the hub lock held
+func (h *Hub) remove(sub *Subscription) {
+	if _, ok := h.subscribers[sub]; !ok {
+		return
+	}
+	delete(h.subscribers, sub)
+	close(sub.events)
+}
@@ -0,0 +1,428 @@
+// Package oidc signs users in with an external OpenID Connect provider using
+// the authorization code flow.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// the provider's keys are fetched again for an unknown kid, but not more often than this
+const minKeyRefreshInterval = time.Minute
+
+// clock skew allowed between us and the provider
+const leeway = time.Minute
+
+// responses from the provider larger than this are refused
+const maxResponseSize = 1 << 20
+
+// signing algorithms accepted on ID tokens. HMAC is left out since the
+// client secret is not a signing key we want to trust.
+var validMethods = []string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "EdDSA"}
+
+// Provider is an OpenID Connect provider users can sign in with. Its
+// endpoints are discovered from the issuer on first use.
+type Provider struct {
+	issuer       string
+	clientId     string
+	clientSecret string
+	redirectURL  string
+	client       *http.Client
+
+	mux           *sync.Mutex
+	metadata      *metadata
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+// NewProvider configures a provider by its issuer URL. httpClient may be nil
+// for http.DefaultClient; tests can pass one that reaches a mock provider.
+func NewProvider(issuer string, clientId string, clientSecret string, redirectURL string, httpClient *http.Client) *Provider {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Provider{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		client:       httpClient,
+		mux:          &sync.Mutex{},
+		keys:         map[string]crypto.PublicKey{},
+	}
+}
+
+// Identity is the user a verified ID token is about
+type Identity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce         string       `json:"nonce"`
+	AuthorizedBy  string       `json:"azp"`
+	Email         string       `json:"email"`
+	EmailVerified flexibleBool `json:"email_verified"`
+}
+
+// flexibleBool accepts "true" as well as true, some providers send strings
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	var value any
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case bool:
+		*b = flexibleBool(v)
+	case string:
+		*b = flexibleBool(v == "true")
+	default:
+		*b = false
+	}
+	return nil
+}
+
+// AuthCodeURL is where to send the user to sign in. The code challenge is
+// the S256 PKCE challenge for the verifier later passed to Exchange.
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, codeChallenge string) (string, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(md.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint: %w", err)
+	}
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.clientId)
+	query.Set("redirect_uri", p.redirectURL)
+	query.Set("scope", "openid email")
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", "S256")
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Exchange redeems an authorization code and returns the identity from the
+// verified ID token, which must carry the nonce the sign in started with
+func (p *Provider) Exchange(ctx context.Context, code string, codeVerifier string, nonce string) (Identity, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	form.Set("code_verifier", codeVerifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, md.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.clientId), url.QueryEscape(p.clientSecret))
+
+	response := struct {
+		IdToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}{}
+	status, err := p.doJSON(req, &response)
+	if err != nil {
+		return Identity{}, err
+	}
+	if status != http.StatusOK {
+		return Identity{}, fmt.Errorf("token request failed with %d: %s %s", status, response.Error, response.Description)
+	}
+	if response.IdToken == "" {
+		return Identity{}, errors.New("token response has no id_token")
+	}
+
+	return p.verifyIDToken(ctx, md, response.IdToken, nonce)
+}
+
+func (p *Provider) verifyIDToken(ctx context.Context, md metadata, rawToken string, nonce string) (Identity, error) {
+	claims := idTokenClaims{}
+	_, err := jwt.ParseWithClaims(rawToken, &claims,
+		func(token *jwt.Token) (any, error) {
+			return p.verificationKey(ctx, md, token)
+		},
+		jwt.WithValidMethods(validMethods),
+		jwt.WithIssuer(md.Issuer),
+		jwt.WithAudience(p.clientId),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(leeway),
+	)
+	if err != nil {
+		return Identity{}, fmt.Errorf("invalid id token: %w", err)
+	}
+
+	if nonce == "" || claims.Nonce != nonce {
+		return Identity{}, errors.New("invalid id token: nonce does not match")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedBy != p.clientId {
+		return Identity{}, errors.New("invalid id token: issued to another party")
+	}
+	if claims.Subject == "" {
+		return Identity{}, errors.New("invalid id token: no subject")
+	}
+
+	return Identity{
+		Issuer:        md.Issuer,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+	}, nil
+}
+
+// discover fetches the provider's metadata. It is only cached once fetched
+// successfully, so a provider that was down at startup is retried.
+func (p *Provider) discover(ctx context.Context) (metadata, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.metadata != nil {
+		return *p.metadata, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return metadata{}, err
+	}
+	md := metadata{}
+	status, err := p.doJSON(req, &md)
+	if err != nil {
+		return metadata{}, fmt.Errorf("discovery failed: %w", err)
+	}
+	if status != http.StatusOK {
+		return metadata{}, fmt.Errorf("discovery failed with %d", status)
+	}
+
+	// the document must be about the issuer we were configured with
+	if strings.TrimSuffix(md.Issuer, "/") != p.issuer {
+		return metadata{}, fmt.Errorf("discovery returned issuer %q, expected %q", md.Issuer, p.issuer)
+	}
+	if md.AuthorizationEndpoint == "" || md.TokenEndpoint == "" || md.JWKSURI == "" {
+		return metadata{}, errors.New("discovery document is missing endpoints")
+	}
+
+	p.metadata = &md
+	return md, nil
+}
+
+// verificationKey finds the provider key a token was signed with, fetching
+// the key set again when the provider may have rotated keys
+func (p *Provider) verificationKey(ctx context.Context, md metadata, token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	key, ok := p.lookupKey(kid)
+	if !ok && time.Since(p.keysFetchedAt) >= minKeyRefreshInterval {
+		err := p.fetchKeys(ctx, md)
+		if err != nil {
+			return nil, err
+		}
+		key, ok = p.lookupKey(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+
+	// the key type has to fit the algorithm, so a key can't be misused
+	switch key.(type) {
+	case *rsa.PublicKey:
+		ok = strings.HasPrefix(token.Method.Alg(), "RS") || strings.HasPrefix(token.Method.Alg(), "PS")
+	case *ecdsa.PublicKey:
+		ok = strings.HasPrefix(token.Method.Alg(), "ES")
+	case ed25519.PublicKey:
+		ok = token.Method.Alg() == "EdDSA"
+	default:
+		ok = false
+	}
+	if !ok {
+		return nil, fmt.Errorf("key %q can't be used with %s", kid, token.Method.Alg())
+	}
+	return key, nil
+}
+
+// lookupKey finds a key by kid. Tokens without a kid are only accepted
+// when the provider has a single key.
+func (p *Provider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" {
+		if len(p.keys) != 1 {
+			return nil, false
+		}
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (p *Provider) fetchKeys(ctx context.Context, md metadata) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, md.JWKSURI, nil)
+	if err != nil {
+		return err
+	}
+	jwks := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	status, err := p.doJSON(req, &jwks)
+	if err != nil {
+		return fmt.Errorf("fetching keys failed: %w", err)
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("fetching keys failed with %d", status)
+	}
+
+	// keys we can't use, such as encryption keys, are skipped
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func (p *Provider) doJSON(req *http.Request, v any) (int, error) {
+	res, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	dat, err := io.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	if err != nil {
+		return 0, err
+	}
+	// error responses may not be JSON, the status is enough then
+	err = json.Unmarshal(dat, v)
+	if err != nil && res.StatusCode == http.StatusOK {
+		return 0, err
+	}
+	return res.StatusCode, nil
+}
@@ -0,0 +1,315 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientId     = "chirpy"
+	testClientSecret = "client-secret"
+	testRedirectURL  = "http://localhost:8080/api/login/oidc/callback"
+	testNonce        = "nonce-123"
+	testVerifier     = "verifier-123"
+	testCode         = "code-123"
+)
+
+// mockProvider is a local OpenID Connect provider serving discovery, its
+// key set and a token endpoint that returns whatever ID token a test wants
+type mockProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+
+	// the id token returned from the token endpoint
+	idToken string
+	// form values of the last token request
+	tokenRequest url.Values
+	// basic auth of the last token request
+	clientId     string
+	clientSecret string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockProvider{key: key, kid: "key-1"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		encode := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": m.kid,
+				"use": "sig",
+				"n":   encode(m.key.N.Bytes()),
+				"e":   encode(big.NewInt(int64(m.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		m.tokenRequest = r.PostForm
+		m.clientId, m.clientSecret, _ = r.BasicAuth()
+		if r.PostForm.Get("code") != testCode {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "provider-access-token",
+			"token_type":   "Bearer",
+			"id_token":     m.idToken,
+		})
+	})
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+
+	return m
+}
+
+func (m *mockProvider) provider() *Provider {
+	return NewProvider(m.server.URL, testClientId, testClientSecret, testRedirectURL, m.server.Client())
+}
+
+// validClaims are the claims of an ID token for a successful login
+func (m *mockProvider) validClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            m.server.URL,
+		"sub":            "user-1",
+		"aud":            testClientId,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          testNonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+}
+
+// sign makes an ID token signed with key under kid
+func (m *mockProvider) sign(t *testing.T, claims jwt.MapClaims, key *rsa.PrivateKey, kid string) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	m := newMockProvider(t)
+
+	authURL, err := m.provider().AuthCodeURL(context.Background(), "state-123", testNonce, "challenge-123")
+	if err != nil {
+		t.Fatalf("AuthCodeURL() error = %v", err)
+	}
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != m.server.URL+"/authorize" {
+		t.Errorf("AuthCodeURL() endpoint = %s, want the discovered one", got)
+	}
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientId,
+		"redirect_uri":          testRedirectURL,
+		"state":                 "state-123",
+		"nonce":                 testNonce,
+		"code_challenge":        "challenge-123",
+		"code_challenge_method": "S256",
+	}
+	for name, value := range want {
+		if got := u.Query().Get(name); got != value {
+			t.Errorf("AuthCodeURL() %s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// changes the valid claims for the case
+		claims func(m *mockProvider, claims jwt.MapClaims)
+		// signs with another key under this kid when set
+		otherKid string
+		code     string
+		want     Identity
+		wantErr  string
+	}{
+		{
+			name: "valid login",
+			want: Identity{Subject: "user-1", Email: "alice@example.com", EmailVerified: true},
+		},
+		{
+			name: "email not verified",
+			claims: func(m *mockProvider, claims jwt.MapClaims) {
+				claims["email_verified"] = false
+			},
+			want: Identity{Subject: "user-1", Email: "alice@example.com", EmailVerified: false},
+		},
+		{
+			name: "email verified sent as a string",
+			claims: func(m *mockProvider, claims jwt.MapClaims) {
+				claims["email_verified"] = "true"
+			},
+			want: Identity{Subject: "user-1", Email: "alice@example.com", EmailVerified: true},
+		},
+		{
+			name: "email verified missing",
+			claims: func(m *mockProvider, claims jwt.MapClaims) {
+				delete(claims, "email_verified")
+			},
+			want: Identity{Subject: "user-1", Email: "alice@example.com", EmailVerified: false},
+		},
+		{
+			name: "wrong nonce",
+			claims: func(m *mockProvider, claims jwt.MapClaims) {
+				claims["nonce"] = "another-nonce"
+			},
+			wantErr: "nonce does not match",
+		},
+		{
+			name: "missing nonce",
+			claims: func(m *mockProvider, claims jwt.MapClaims) {
+				delete(claims, "nonce")
+			},
+			wantErr: "nonce does not match",
+		},
+		{
+			name: "wrong audience",
+			claims: func(m *mockProvider, claims jwt.MapClaims) {
+				claims["aud"] = "another-client"
+			},
+			wantErr: "audience",
+		},
+		{
+			name: "several audiences without azp",
+			claims: func(m *mockProvider, claims jwt.MapClaims) {
+				claims["aud"] = []string{testClientId, "another-client"}
+			},
+			wantErr: "issued to another party",
+		},
+		{
+			name: "wrong issuer",
+			claims: func(m *mockProvider, claims jwt.MapClaims) {
+				claims["iss"] = "https://attacker.example.com"
+			},
+			wantErr: "issuer",
+		},
+		{
+			name: "expired",
+			claims: func(m *mockProvider, claims jwt.MapClaims) {
+				claims["exp"] = time.Now().Add(-time.Hour).Unix()
+			},
+			wantErr: "expired",
+		},
+		{
+			name:     "unknown kid",
+			otherKid: "key-2",
+			wantErr:  `unknown kid "key-2"`,
+		},
+		{
+			name:     "known kid signed by another key",
+			otherKid: "key-1",
+			wantErr:  "signature is invalid",
+		},
+		{
+			name:    "code refused by the provider",
+			code:    "wrong-code",
+			wantErr: "token request failed with 400",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockProvider(t)
+
+			claims := m.validClaims()
+			if tt.claims != nil {
+				tt.claims(m, claims)
+			}
+			if tt.otherKid != "" {
+				m.idToken = m.sign(t, claims, otherKey, tt.otherKid)
+			} else {
+				m.idToken = m.sign(t, claims, m.key, m.kid)
+			}
+			code := testCode
+			if tt.code != "" {
+				code = tt.code
+			}
+
+			identity, err := m.provider().Exchange(context.Background(), code, testVerifier, testNonce)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Exchange() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Exchange() error = %v", err)
+			}
+
+			tt.want.Issuer = m.server.URL
+			if identity != tt.want {
+				t.Errorf("Exchange() = %+v, want %+v", identity, tt.want)
+			}
+
+			// the code is redeemed with the PKCE verifier and client credentials
+			if m.tokenRequest.Get("grant_type") != "authorization_code" ||
+				m.tokenRequest.Get("code_verifier") != testVerifier ||
+				m.tokenRequest.Get("redirect_uri") != testRedirectURL {
+				t.Errorf("token request = %v", m.tokenRequest)
+			}
+			if m.clientId != testClientId || m.clientSecret != testClientSecret {
+				t.Errorf("token request client = %q %q, want %q %q", m.clientId, m.clientSecret, testClientId, testClientSecret)
+			}
+		})
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	m := newMockProvider(t)
+
+	// a document at one issuer claiming to be another is refused
+	p := NewProvider(m.server.URL+"/tenant", testClientId, testClientSecret, testRedirectURL, m.server.Client())
+	_, err := p.AuthCodeURL(context.Background(), "state", testNonce, "challenge")
+	if err == nil {
+		t.Fatal("AuthCodeURL() succeeded against a provider that failed discovery")
+	}
+}
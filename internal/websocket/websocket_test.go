@@ -0,0 +1,297 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+)
+
+// fakeConn records what the server writes, reads come from Conn.br
+type fakeConn struct {
+	net.Conn
+	written bytes.Buffer
+	closed  bool
+}
+
+func (f *fakeConn) Write(b []byte) (int, error) {
+	return f.written.Write(b)
+}
+
+func (f *fakeConn) Close() error {
+	f.closed = true
+	return nil
+}
+
+func newTestConn(input []byte) (*Conn, *fakeConn) {
+	fake := &fakeConn{}
+	return &Conn{
+		conn: fake,
+		br:   bufio.NewReader(bytes.NewReader(input)),
+		wmux: &sync.Mutex{},
+	}, fake
+}
+
+// the masking key used by the examples in RFC 6455 section 5.7
+var exampleMask = []byte{0x37, 0xfa, 0x21, 0x3d}
+
+// masked turns an unmasked frame from the examples into the frame a client
+// would send, clients must mask every frame
+func masked(frame []byte) []byte {
+	headerLength := 2
+	switch frame[1] {
+	case 126:
+		headerLength = 4
+	case 127:
+		headerLength = 10
+	}
+
+	out := append([]byte{}, frame[:headerLength]...)
+	out[1] |= 0x80
+	out = append(out, exampleMask...)
+	for i, b := range frame[headerLength:] {
+		out = append(out, b^exampleMask[i%4])
+	}
+	return out
+}
+
+func concat(frames ...[]byte) []byte {
+	return bytes.Join(frames, nil)
+}
+
+func TestAcceptKey(t *testing.T) {
+	// RFC 6455 section 1.3
+	got := acceptKey("dGhlIHNhbXBsZSBub25jZQ==")
+	want := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	if got != want {
+		t.Errorf("acceptKey() = %q, want %q", got, want)
+	}
+}
+
+func TestMaskedExampleMatchesRFC(t *testing.T) {
+	// the single-frame masked "Hello" from RFC 6455 section 5.7
+	want := []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}
+	got := masked([]byte{0x81, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f})
+	if !bytes.Equal(got, want) {
+		t.Fatalf("masked() = % x, want % x", got, want)
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	hello := []byte{0x81, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f}
+	// "Hel" then "lo" as a text message in two fragments
+	helloFirst := []byte{0x01, 0x03, 0x48, 0x65, 0x6c}
+	helloLast := []byte{0x80, 0x02, 0x6c, 0x6f}
+	ping := []byte{0x89, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f}
+	pongReply := []byte{0x8a, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f}
+
+	binary256 := append([]byte{0x82, 0x7e, 0x01, 0x00}, bytes.Repeat([]byte{0xab}, 256)...)
+	binary64k := append([]byte{0x82, 0x7f, 0, 0, 0, 0, 0, 0x01, 0x00, 0x00}, bytes.Repeat([]byte{0xcd}, 65536)...)
+
+	tests := []struct {
+		name        string
+		input       []byte
+		wantType    int
+		wantMessage []byte
+		// frames the server writes while reading
+		wantWritten []byte
+	}{
+		{
+			name:        "single masked frame",
+			input:       masked(hello),
+			wantType:    TextMessage,
+			wantMessage: []byte("Hello"),
+		},
+		{
+			name:        "fragmented message",
+			input:       concat(masked(helloFirst), masked(helloLast)),
+			wantType:    TextMessage,
+			wantMessage: []byte("Hello"),
+		},
+		{
+			name:        "ping between fragments is answered",
+			input:       concat(masked(helloFirst), masked(ping), masked(helloLast)),
+			wantType:    TextMessage,
+			wantMessage: []byte("Hello"),
+			wantWritten: pongReply,
+		},
+		{
+			name:        "ping before message is answered",
+			input:       concat(masked(ping), masked(hello)),
+			wantType:    TextMessage,
+			wantMessage: []byte("Hello"),
+			wantWritten: pongReply,
+		},
+		{
+			name:        "256 bytes with 16 bit length",
+			input:       masked(binary256),
+			wantType:    BinaryMessage,
+			wantMessage: binary256[4:],
+		},
+		{
+			name:        "64 KiB with 64 bit length",
+			input:       masked(binary64k),
+			wantType:    BinaryMessage,
+			wantMessage: binary64k[10:],
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, fake := newTestConn(tt.input)
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("ReadMessage() error = %v", err)
+			}
+			if messageType != tt.wantType {
+				t.Errorf("ReadMessage() type = %d, want %d", messageType, tt.wantType)
+			}
+			if !bytes.Equal(message, tt.wantMessage) {
+				t.Errorf("ReadMessage() message = %q, want %q", message, tt.wantMessage)
+			}
+			if !bytes.Equal(fake.written.Bytes(), tt.wantWritten) {
+				t.Errorf("written = % x, want % x", fake.written.Bytes(), tt.wantWritten)
+			}
+		})
+	}
+}
+
+func TestReadMessageProtocolErrors(t *testing.T) {
+	hello := []byte{0x81, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f}
+	helloFirst := []byte{0x01, 0x03, 0x48, 0x65, 0x6c}
+	helloLast := []byte{0x80, 0x02, 0x6c, 0x6f}
+
+	tests := []struct {
+		name     string
+		input    []byte
+		wantCode int
+	}{
+		{
+			name:     "unmasked client frame",
+			input:    hello,
+			wantCode: CloseProtocol,
+		},
+		{
+			name:     "continuation without a first fragment",
+			input:    masked(helloLast),
+			wantCode: CloseProtocol,
+		},
+		{
+			name:     "new message before the last fragment",
+			input:    concat(masked(helloFirst), masked(hello)),
+			wantCode: CloseProtocol,
+		},
+		{
+			name:     "fragmented control frame",
+			input:    masked([]byte{0x09, 0x00}),
+			wantCode: CloseProtocol,
+		},
+		{
+			name:     "reserved bits set",
+			input:    masked([]byte{0xc1, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f}),
+			wantCode: CloseProtocol,
+		},
+		{
+			name:     "unknown opcode",
+			input:    masked([]byte{0x83, 0x00}),
+			wantCode: CloseProtocol,
+		},
+		{
+			name:     "frame over the size limit",
+			input:    masked(append([]byte{0x82, 0x7f, 0, 0, 0, 0, 0, 0x01, 0x00, 0x01}, make([]byte, 65537)...)),
+			wantCode: CloseTooBig,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, fake := newTestConn(tt.input)
+			_, _, err := conn.ReadMessage()
+
+			closeErr := &CloseError{}
+			if !errors.As(err, &closeErr) {
+				t.Fatalf("ReadMessage() error = %v, want a *CloseError", err)
+			}
+			if closeErr.Code != tt.wantCode {
+				t.Errorf("close code = %d, want %d", closeErr.Code, tt.wantCode)
+			}
+			if !fake.closed {
+				t.Error("connection was not closed")
+			}
+			// the close frame sent to the client carries the same code
+			written := fake.written.Bytes()
+			if len(written) < 4 || written[0] != 0x88 || int(written[2])<<8|int(written[3]) != tt.wantCode {
+				t.Errorf("close frame = % x, want code %d", written, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestReadMessageClose(t *testing.T) {
+	closeFrame := masked([]byte{0x88, 0x05, 0x03, 0xe8, 'b', 'y', 'e'})
+	conn, fake := newTestConn(closeFrame)
+
+	_, _, err := conn.ReadMessage()
+	closeErr := &CloseError{}
+	if !errors.As(err, &closeErr) {
+		t.Fatalf("ReadMessage() error = %v, want a *CloseError", err)
+	}
+	if closeErr.Code != CloseNormal || closeErr.Reason != "bye" {
+		t.Errorf("ReadMessage() = %d %q, want %d %q", closeErr.Code, closeErr.Reason, CloseNormal, "bye")
+	}
+
+	// the close is echoed, and nothing can be written after it
+	want := []byte{0x88, 0x02, 0x03, 0xe8}
+	if !bytes.Equal(fake.written.Bytes(), want) {
+		t.Errorf("written = % x, want % x", fake.written.Bytes(), want)
+	}
+	if conn.WriteMessage(TextMessage, []byte("late")) == nil {
+		t.Error("WriteMessage() after close succeeded")
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	tests := []struct {
+		name        string
+		messageType int
+		payload     []byte
+		wantHeader  []byte
+	}{
+		{
+			// the unmasked "Hello" from RFC 6455 section 5.7
+			name:        "7 bit length",
+			messageType: TextMessage,
+			payload:     []byte("Hello"),
+			wantHeader:  []byte{0x81, 0x05},
+		},
+		{
+			name:        "16 bit length",
+			messageType: BinaryMessage,
+			payload:     make([]byte, 256),
+			wantHeader:  []byte{0x82, 0x7e, 0x01, 0x00},
+		},
+		{
+			name:        "64 bit length",
+			messageType: BinaryMessage,
+			payload:     make([]byte, 65536),
+			wantHeader:  []byte{0x82, 0x7f, 0, 0, 0, 0, 0, 0x01, 0x00, 0x00},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, fake := newTestConn(nil)
+			err := conn.WriteMessage(tt.messageType, tt.payload)
+			if err != nil {
+				t.Fatalf("WriteMessage() error = %v", err)
+			}
+
+			want := concat(tt.wantHeader, tt.payload)
+			if !bytes.Equal(fake.written.Bytes(), want) {
+				t.Errorf("written header = % x, want % x", fake.written.Bytes()[:len(tt.wantHeader)], tt.wantHeader)
+			}
+		})
+	}
+}
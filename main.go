@@ -1,20 +1,56 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
 	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/events"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/mailer"
+	"github.com/jbeyer16/boot-dev-chirpy/internal/oidc"
 	"github.com/joho/godotenv"
+	"golang.org/x/exp/slices"
 )
 
 const port = "8080"
 
 const databaseFile = "database.json"
 
+const shutdownTimeout = 10 * time.Second
+
+// requests to the login provider are made while the user waits
+const oidcRequestTimeout = 10 * time.Second
+
+// a few typos are free, after that each failure doubles the wait
+var accountLockoutPolicy = auth.LockoutPolicy{
+	Threshold:   5,
+	BaseLockout: 30 * time.Second,
+	MaxLockout:  time.Hour,
+	ResetAfter:  time.Hour,
+}
+
+// one address may be shared by many users, so it gets more leeway
+var ipLockoutPolicy = auth.LockoutPolicy{
+	Threshold:   20,
+	BaseLockout: time.Minute,
+	MaxLockout:  time.Hour,
+	ResetAfter:  time.Hour,
+}
+
 func main() {
 	godotenv.Load()
 
@@ -24,45 +60,239 @@ func main() {
 		os.Remove(databaseFile)
 	}
 
+	mail, err := mailerFromEnv()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	unverifiedRestrictions := []string{}
+	for _, action := range strings.Split(os.Getenv("UNVERIFIED_RESTRICTIONS"), ",") {
+		action = strings.TrimSpace(action)
+		if action == "" {
+			continue
+		}
+		if !slices.Contains(restrictableActions, action) {
+			fmt.Printf("Unknown UNVERIFIED_RESTRICTIONS action %q, expected one of %v\n", action, restrictableActions)
+			return
+		}
+		unverifiedRestrictions = append(unverifiedRestrictions, action)
+	}
+
 	DB, err := database.NewDB(databaseFile)
 	if err != nil {
 		fmt.Println("Unable to read database")
 		return
 	}
 
-	jwtSecret := os.Getenv("JWT_SECRET")
+	jwtKeys, err := jwtKeysFromEnv()
+	if err != nil {
+		fmt.Println("Unable to load JWT keys:", err)
+		return
+	}
 	polkaApiKey := os.Getenv("POLKA_API_KEY")
+	adminApiKey := os.Getenv("ADMIN_API_KEY")
+
+	// public address used for links in feeds
+	baseURL := strings.TrimSuffix(os.Getenv("BASE_URL"), "/")
+	if baseURL == "" {
+		baseURL = "http://localhost:" + port
+	}
+
+	trendingWindow := defaultTrendingWindow
+	if window := os.Getenv("TRENDING_WINDOW"); window != "" {
+		trendingWindow, err = time.ParseDuration(window)
+		if err != nil || trendingWindow <= 0 {
+			fmt.Println("Invalid TRENDING_WINDOW, expected a duration like 24h")
+			return
+		}
+	}
+
+	deletionGracePeriod := defaultDeletionGracePeriod
+	if grace := os.Getenv("ACCOUNT_DELETION_GRACE"); grace != "" {
+		deletionGracePeriod, err = time.ParseDuration(grace)
+		if err != nil || deletionGracePeriod < 0 {
+			fmt.Println("Invalid ACCOUNT_DELETION_GRACE, expected a duration like 168h")
+			return
+		}
+	}
+
+	corsOrigins, err := corsOriginsFromEnv()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	passwords, err := passwordHasherFromEnv()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	totpSecrets, err := totpSecretBoxFromEnv()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	// secrets stored before they were encrypted are sealed now
+	err = DB.UpdateTOTPSecrets(func(secret string) (string, error) {
+		if auth.IsSealed(secret) {
+			return secret, nil
+		}
+		return totpSecrets.Seal(secret)
+	})
+	if err != nil {
+		fmt.Println("Unable to encrypt two-factor secrets:", err)
+		return
+	}
+
+	oidcProvider, err := oidcProviderFromEnv(baseURL)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	apiCfg := apiConfig{
 		fileserverHits: 0,
 		db:             DB,
-		jwtSecret:      jwtSecret,
+		jwtKeys:        jwtKeys,
 		polkaApiKey:    polkaApiKey,
+		adminApiKey:    adminApiKey,
+		baseURL:        baseURL,
+		impressions:    newImpressionCounter(),
+		trending:       newTrendingCache(trendingWindow),
+		events:         events.NewHub(),
+		websockets:     &sync.WaitGroup{},
+		mailer:         mail,
+		loginLimiter:   auth.NewLoginLimiter(accountLockoutPolicy, ipLockoutPolicy),
+		oidc:           oidcProvider,
+		passwords:      passwords,
+		totpSecrets:    totpSecrets,
+
+		deletionGracePeriod:    deletionGracePeriod,
+		unverifiedRestrictions: unverifiedRestrictions,
 	}
 
+	apiCfg.authenticator = auth.NewAuthenticator(jwtKeys, apiCfg.authenticatePersonalToken, apiCfg.checkSession, respondUnauthorized)
+
+	done := make(chan struct{})
+	defer close(done)
+	go apiCfg.impressions.run(DB, impressionFlushInterval, done)
+	go apiCfg.trending.run(DB, trendingRefreshInterval, done)
+	go apiCfg.purgeDeletedAccounts(accountPurgeInterval, done)
+
 	r := chi.NewRouter()
-	corsMux := middlewareCors(r)
+	corsMux := middlewareCors(corsOrigins)(r)
 
 	fsHandler := apiCfg.middlewareMetricsInc(fileServerHandler)
 	r.Handle("/app/*", fsHandler)
 	r.Handle("/app", fsHandler)
+	r.Get("/.well-known/jwks.json", apiCfg.getJWKS)
+
+	// OAuth endpoints for third-party apps, these authenticate the client
+	r.With(middlewareNoFraming).Get("/oauth/authorize", apiCfg.authorize)
+	r.Post("/oauth/token", apiCfg.oauthToken)
+	r.Post("/oauth/revoke", apiCfg.oauthRevoke)
+	r.Post("/oauth/introspect", apiCfg.oauthIntrospect)
 
 	apiRouter := chi.NewRouter()
 	apiRouter.Get("/healthz", healthHandler)
-	apiRouter.Post("/chirps", apiCfg.createChirp)
-	apiRouter.Get("/chirps", apiCfg.getChirps)
+	apiRouter.Get("/chirps/stream", apiCfg.streamChirps)
+	// authenticates itself, browsers can't send headers on websocket requests
+	apiRouter.Get("/ws", apiCfg.websocketHandler)
 	apiRouter.Get("/chirps/{chirpId}", apiCfg.getChirpById)
 	apiRouter.Post("/users", apiCfg.createUser)
+	apiRouter.Post("/users/verify", apiCfg.verifyEmail)
 	apiRouter.Post("/login", apiCfg.loginUser)
-	apiRouter.Put("/users", apiCfg.updateUser)
+	apiRouter.Post("/login/2fa", apiCfg.loginTwoFactor)
+	apiRouter.Post("/login/magic-link", apiCfg.requestMagicLink)
+	apiRouter.Post("/login/magic-link/confirm", apiCfg.confirmMagicLink)
+	apiRouter.Get("/login/oidc", apiCfg.startOIDCLogin)
+	apiRouter.Get("/login/oidc/callback", apiCfg.oidcCallback)
+	apiRouter.Post("/password-reset", apiCfg.requestPasswordReset)
+	apiRouter.Post("/password-reset/confirm", apiCfg.confirmPasswordReset)
+	apiRouter.Get("/users/{userId}", apiCfg.getUserProfile)
+	apiRouter.Get("/users/by-handle/{handle}", apiCfg.getUserProfileByHandle)
+	apiRouter.Get("/users/{userId}/feed.{format}", apiCfg.getUserFeed)
+	apiRouter.Get("/hashtags/{tag}/feed.{format}", apiCfg.getHashtagFeed)
+	// these take a refresh token rather than an access token
 	apiRouter.Post("/refresh", apiCfg.refreshToken)
 	apiRouter.Post("/revoke", apiCfg.revokeToken)
-	apiRouter.Delete("/chirps/{chirpId}", apiCfg.deleteChirp)
 	apiRouter.Post("/polka/webhooks", apiCfg.upgradeUser)
+	apiRouter.Get("/trending", apiCfg.getTrending)
+	apiRouter.Get("/oauth/authorize", apiCfg.getAuthorizationRequest)
+
+	// signed in users get a personalized response
+	apiRouter.Group(func(r chi.Router) {
+		r.Use(apiCfg.authenticator.Optional)
+		r.Use(middlewareRequireScope(scopeChirpsRead))
+		r.Get("/chirps", apiCfg.getChirps)
+		r.Get("/chirps/{chirpId}/poll", apiCfg.getPoll)
+	})
+
+	// routes personal access tokens can be scoped to
+	apiRouter.Group(func(r chi.Router) {
+		r.Use(apiCfg.authenticator.Required)
+		r.With(middlewareRequireScope(scopeChirpsWrite)).Post("/chirps", apiCfg.createChirp)
+		r.With(middlewareRequireScope(scopeChirpsWrite)).Delete("/chirps/{chirpId}", apiCfg.deleteChirp)
+		r.With(middlewareRequireScope(scopeChirpsWrite)).Post("/chirps/{chirpId}/poll/votes", apiCfg.voteOnPoll)
+		r.With(middlewareRequireScope(scopeChirpsWrite)).Put("/chirps/{chirpId}/reaction", apiCfg.reactToChirp)
+		r.With(middlewareRequireScope(scopeChirpsWrite)).Delete("/chirps/{chirpId}/reaction", apiCfg.deleteReaction)
+		r.With(middlewareRequireScope(scopeProfileWrite)).Put("/users/me/profile", apiCfg.updateProfile)
+		r.With(middlewareRequireScope(scopeProfileWrite)).Put("/users/me/avatar", apiCfg.uploadAvatar)
+	})
+
+	apiRouter.Group(func(r chi.Router) {
+		r.Use(apiCfg.authenticator.Required)
+		r.Use(middlewareFullAccess)
+		r.Post("/users/verify/resend", apiCfg.resendVerification)
+		r.Put("/users", apiCfg.updateUser)
+		r.Delete("/users/me", apiCfg.deleteAccount)
+		r.Get("/users/me/export", apiCfg.exportAccount)
+		r.Post("/users/me/2fa/totp", apiCfg.enrollTOTP)
+		r.Post("/users/me/2fa/totp/confirm", apiCfg.confirmTOTP)
+		r.Delete("/users/me/2fa/totp", apiCfg.disableTOTP)
+		r.Get("/users/me/analytics", apiCfg.getAuthorAnalytics)
+		r.Get("/users/me/blocks", apiCfg.getBlockedUsers)
+		r.Get("/users/me/mutes", apiCfg.getMutedUsers)
+		r.Post("/users/{userId}/block", apiCfg.blockUser)
+		r.Delete("/users/{userId}/block", apiCfg.unblockUser)
+		r.Post("/users/{userId}/mute", apiCfg.muteUser)
+		r.Delete("/users/{userId}/mute", apiCfg.unmuteUser)
+		r.Post("/users/me/tokens", apiCfg.createPersonalToken)
+		r.Get("/users/me/tokens", apiCfg.getPersonalTokens)
+		r.Delete("/users/me/tokens/{tokenId}", apiCfg.deletePersonalToken)
+		r.Post("/oauth/authorize", apiCfg.decideAuthorization)
+		r.Post("/oauth/clients", apiCfg.createOAuthClient)
+		r.Get("/oauth/clients", apiCfg.getOAuthClients)
+		r.Delete("/oauth/clients/{clientId}", apiCfg.deleteOAuthClient)
+		r.Get("/sessions", apiCfg.getSessions)
+		r.Delete("/sessions/{sessionId}", apiCfg.deleteSession)
+		r.Get("/notifications", apiCfg.getNotifications)
+		r.Post("/notifications/read", apiCfg.markNotificationsRead)
+		r.Get("/notifications/settings", apiCfg.getNotificationSettings)
+		r.Put("/notifications/settings", apiCfg.updateNotificationSettings)
+		r.Post("/conversations", apiCfg.createConversation)
+		r.Get("/conversations", apiCfg.getConversations)
+		r.Get("/conversations/{conversationId}", apiCfg.getConversation)
+		r.Get("/conversations/{conversationId}/messages", apiCfg.getMessages)
+		r.Post("/conversations/{conversationId}/messages", apiCfg.createMessage)
+		r.Post("/conversations/{conversationId}/read", apiCfg.markConversationRead)
+	})
+	// cookie sessions, the refresh token comes from a cookie so these need
+	// the CSRF header too
+	apiRouter.Group(func(r chi.Router) {
+		r.Use(middlewareCSRF)
+		r.Post("/session/refresh", apiCfg.refreshCookieSession)
+		r.Post("/session/logout", apiCfg.logoutCookieSession)
+	})
 	r.Mount("/api", apiRouter)
 
 	adminRouter := chi.NewRouter()
 	adminRouter.Get("/metrics", apiCfg.metricsHandler)
 	adminRouter.Get("/reset", apiCfg.metricsResetHandler)
+	adminRouter.Get("/lockouts", apiCfg.getLockouts)
+	adminRouter.Delete("/lockouts", apiCfg.clearLockout)
 	r.Mount("/admin", adminRouter)
 
 	server := &http.Server{
@@ -70,8 +300,217 @@ func main() {
 		Handler: corsMux,
 	}
 
+	// closing the hub ends every stream and websocket subscription
+	server.RegisterOnShutdown(apiCfg.events.Close)
+
+	// shut down cleanly on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			fmt.Println("Unable to shut down cleanly:", err)
+		}
+
+		// websockets are hijacked so Shutdown doesn't wait on them
+		websocketsDone := make(chan struct{})
+		go func() {
+			apiCfg.websockets.Wait()
+			close(websocketsDone)
+		}()
+		select {
+		case <-websocketsDone:
+		case <-shutdownCtx.Done():
+		}
+	}()
+
 	err = server.ListenAndServe()
-	if err != nil {
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		fmt.Println(err)
+		return
+	}
+	<-shutdownDone
+
+	err = apiCfg.impressions.flush(DB)
+	if err != nil {
+		fmt.Println("Unable to flush impressions:", err)
+	}
+}
+
+// mailerFromEnv picks the mailer from MAILER: "smtp" sends through
+// SMTP_HOST, anything else writes messages to the MAIL_OUTBOX directory.
+// Messages carry sign in links, so the default outbox is kept out of the
+// served files in the temp directory.
+func mailerFromEnv() (mailer.Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Chirpy <no-reply@chirpy.local>"
+	}
+
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, errors.New("MAILER=smtp requires SMTP_HOST")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return mailer.SMTPMailer{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}, nil
+	case "", "outbox":
+		dir := os.Getenv("MAIL_OUTBOX")
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), "chirpy-outbox")
+		}
+		return mailer.OutboxMailer{Dir: dir, From: from}, nil
+	default:
+		return nil, errors.New("MAILER must be smtp or outbox")
+	}
+}
+
+// passwordHasherFromEnv picks how new passwords are hashed. PASSWORD_HASH is
+// argon2id (the default) or bcrypt, tuned with ARGON2_MEMORY (KiB),
+// ARGON2_ITERATIONS and ARGON2_PARALLELISM, or BCRYPT_COST.
+// PASSWORD_HASH_CONCURRENCY caps how many run at once, one per CPU by
+// default. Existing hashes are upgraded as users log in.
+func passwordHasherFromEnv() (*auth.PasswordHasher, error) {
+	params := auth.DefaultPasswordParams
+	if algorithm := os.Getenv("PASSWORD_HASH"); algorithm != "" {
+		params.Algorithm = algorithm
+	}
+
+	settings := []struct {
+		name string
+		bits int
+		set  func(n uint64)
+	}{
+		{"ARGON2_MEMORY", 32, func(n uint64) { params.Argon2Memory = uint32(n) }},
+		{"ARGON2_ITERATIONS", 32, func(n uint64) { params.Argon2Iterations = uint32(n) }},
+		{"ARGON2_PARALLELISM", 8, func(n uint64) { params.Argon2Parallelism = uint8(n) }},
+		{"BCRYPT_COST", 8, func(n uint64) { params.BcryptCost = int(n) }},
+		{"PASSWORD_HASH_CONCURRENCY", 16, func(n uint64) { params.MaxConcurrent = int(n) }},
+	}
+	for _, setting := range settings {
+		value := os.Getenv(setting.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(value, 10, setting.bits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s, expected a positive number", setting.name)
+		}
+		setting.set(n)
 	}
+
+	hasher, err := auth.NewPasswordHasher(params)
+	if err != nil {
+		return nil, fmt.Errorf("invalid password hash settings: %w", err)
+	}
+	return hasher, nil
+}
+
+// totpSecretBoxFromEnv encrypts TOTP secrets with TOTP_ENCRYPTION_KEY. It
+// has to be a key of its own, changing it breaks every enrolled
+// authenticator, so it can't be tied to rotating JWT_SECRET.
+func totpSecretBoxFromEnv() (*auth.SecretBox, error) {
+	key := os.Getenv("TOTP_ENCRYPTION_KEY")
+	if key == "" {
+		return nil, errors.New("TOTP_ENCRYPTION_KEY environment variable is not set")
+	}
+	if key == os.Getenv("JWT_SECRET") {
+		return nil, errors.New("TOTP_ENCRYPTION_KEY must not be the same as JWT_SECRET")
+	}
+	return auth.NewSecretBox(key)
+}
+
+// corsOriginsFromEnv reads CORS_ALLOWED_ORIGINS, a comma separated list of
+// origins like https://app.example.com that may make credentialed requests
+func corsOriginsFromEnv() ([]string, error) {
+	origins := []string{}
+	for _, origin := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("invalid CORS_ALLOWED_ORIGINS origin %q, expected one like https://app.example.com", origin)
+		}
+		origins = append(origins, origin)
+	}
+	return origins, nil
+}
+
+// oidcProviderFromEnv configures login through the OpenID Connect provider
+// at OIDC_ISSUER, if set, with OIDC_CLIENT_ID and OIDC_CLIENT_SECRET. The
+// provider must allow BASE_URL/api/login/oidc/callback as a redirect URI.
+func oidcProviderFromEnv(baseURL string) (*oidc.Provider, error) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+	clientId := os.Getenv("OIDC_CLIENT_ID")
+	if clientId == "" {
+		return nil, errors.New("OIDC_ISSUER requires OIDC_CLIENT_ID")
+	}
+
+	client := &http.Client{Timeout: oidcRequestTimeout}
+	return oidc.NewProvider(issuer, clientId, os.Getenv("OIDC_CLIENT_SECRET"), baseURL+oidcCallbackPath, client), nil
+}
+
+// jwtKeysFromEnv signs tokens with the private key at JWT_SIGNING_KEY if set,
+// also accepting the keys listed in JWT_VERIFICATION_KEYS while they are
+// rotated out. Otherwise tokens are signed with the JWT_SECRET shared secret.
+// Tokens signed with JWT_SECRET before a signing key was configured are only
+// accepted with JWT_ACCEPT_LEGACY_HS256=true, which should be turned off once
+// the longest lived of them has expired.
+func jwtKeysFromEnv() (*auth.KeySet, error) {
+	secret := os.Getenv("JWT_SECRET")
+	signingKey := os.Getenv("JWT_SIGNING_KEY")
+	if signingKey == "" {
+		if secret == "" {
+			return nil, errors.New("JWT_SECRET or JWT_SIGNING_KEY must be set")
+		}
+		return auth.NewHMACKeySet(secret), nil
+	}
+
+	legacySecret := ""
+	acceptLegacy := false
+	if value := os.Getenv("JWT_ACCEPT_LEGACY_HS256"); value != "" {
+		var err error
+		acceptLegacy, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New("invalid JWT_ACCEPT_LEGACY_HS256, expected true or false")
+		}
+	}
+	if acceptLegacy {
+		if secret == "" {
+			return nil, errors.New("JWT_ACCEPT_LEGACY_HS256 needs the old JWT_SECRET")
+		}
+		legacySecret = secret
+	}
+
+	verificationKeys := []string{}
+	for _, path := range strings.Split(os.Getenv("JWT_VERIFICATION_KEYS"), ",") {
+		path = strings.TrimSpace(path)
+		if path != "" {
+			verificationKeys = append(verificationKeys, path)
+		}
+	}
+
+	return auth.LoadKeySet(signingKey, verificationKeys, legacySecret)
 }
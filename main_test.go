@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
+)
+
+func TestJWTKeysFromEnv(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKey := filepath.Join(t.TempDir(), "signing.pem")
+	err = os.WriteFile(signingKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: dat}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacy, err := auth.IssueJWT("chirpy-access", 1, auth.NewHMACKeySet("old secret"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantErr      bool
+		acceptLegacy bool
+	}{
+		{"shared secret", map[string]string{"JWT_SECRET": "old secret"}, false, true},
+		{"nothing set", map[string]string{}, true, false},
+		{"signing key", map[string]string{"JWT_SIGNING_KEY": signingKey, "JWT_SECRET": "old secret"}, false, false},
+		{"signing key accepting legacy tokens", map[string]string{"JWT_SIGNING_KEY": signingKey, "JWT_SECRET": "old secret", "JWT_ACCEPT_LEGACY_HS256": "true"}, false, true},
+		{"legacy tokens without the secret", map[string]string{"JWT_SIGNING_KEY": signingKey, "JWT_ACCEPT_LEGACY_HS256": "true"}, true, false},
+		{"legacy setting not a bool", map[string]string{"JWT_SIGNING_KEY": signingKey, "JWT_ACCEPT_LEGACY_HS256": "sometimes"}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"JWT_SECRET", "JWT_SIGNING_KEY", "JWT_VERIFICATION_KEYS", "JWT_ACCEPT_LEGACY_HS256"} {
+				t.Setenv(name, tt.env[name])
+			}
+
+			keys, err := jwtKeysFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("jwtKeysFromEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			_, _, err = auth.ValidateJWT(legacy, keys)
+			if (err == nil) != tt.acceptLegacy {
+				t.Errorf("ValidateJWT() of an HS256 token error = %v, want accepted %v", err, tt.acceptLegacy)
+			}
+		})
+	}
+}
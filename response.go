@@ -34,3 +34,8 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.WriteHeader(code)
 	w.Write(dat)
 }
+
+// respondUnauthorized is the response for missing or invalid credentials
+func respondUnauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/auth"
+)
+
+// scopes a personal access token can be limited to
+const (
+	scopeChirpsRead   = "chirps:read"
+	scopeChirpsWrite  = "chirps:write"
+	scopeProfileWrite = "profile:write"
+)
+
+var grantableScopes = []string{scopeChirpsRead, scopeChirpsWrite, scopeProfileWrite}
+
+// middlewareRequireScope rejects scoped credentials without the given scope.
+// Anonymous requests are left to the route's auth middleware.
+func middlewareRequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := auth.PrincipalFromContext(r.Context())
+			if ok && !principal.HasScope(scope) {
+				respondWithError(w, http.StatusForbidden, "Token is missing the "+scope+" scope")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// middlewareFullAccess keeps scoped credentials out of routes no scope
+// covers, such as account settings or minting more tokens
+func middlewareFullAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if ok && len(principal.Scopes) > 0 {
+			respondWithError(w, http.StatusForbidden, "Scoped tokens can't be used here")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
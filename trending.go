@@ -0,0 +1,202 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jbeyer16/boot-dev-chirpy/internal/database"
+	"golang.org/x/exp/slices"
+)
+
+const defaultTrendingWindow = 24 * time.Hour
+const trendingRefreshInterval = time.Minute
+
+// how much a single poll vote counts compared to an impression
+const trendingVoteWeight = 5.0
+
+// how much each use of a hashtag counts on top of its chirps' engagement
+const trendingHashtagUseWeight = 10.0
+
+var hashtagPattern = regexp.MustCompile(`(?:^|\s)#(\w+)`)
+
+// extractHashtags returns the distinct lowercase hashtags in a chirp body
+func extractHashtags(body string) []string {
+	tags := []string{}
+	for _, match := range hashtagPattern.FindAllStringSubmatch(body, -1) {
+		tag := strings.ToLower(match[1])
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+type trendingHashtag struct {
+	Tag   string  `json:"tag"`
+	Score float64 `json:"score"`
+}
+
+type trendingChirp struct {
+	database.Chirp
+	Score float64 `json:"score"`
+}
+
+type trendingSnapshot struct {
+	Hashtags   []trendingHashtag `json:"hashtags"`
+	Chirps     []trendingChirp   `json:"chirps"`
+	ComputedAt time.Time         `json:"computed_at"`
+}
+
+// trendingCache holds the latest trending snapshot, recomputed in the
+// background so requests never scan the chirp store themselves
+type trendingCache struct {
+	mux      *sync.RWMutex
+	window   time.Duration
+	snapshot trendingSnapshot
+}
+
+func newTrendingCache(window time.Duration) *trendingCache {
+	return &trendingCache{
+		mux:    &sync.RWMutex{},
+		window: window,
+		snapshot: trendingSnapshot{
+			Hashtags: []trendingHashtag{},
+			Chirps:   []trendingChirp{},
+		},
+	}
+}
+
+func (t *trendingCache) get() trendingSnapshot {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+
+	return t.snapshot
+}
+
+func (t *trendingCache) refresh(db *database.DB) error {
+	chirps, err := db.GetChirps()
+	if err != nil {
+		return err
+	}
+
+	chirpIds := make([]int, 0, len(chirps))
+	for _, chirp := range chirps {
+		chirpIds = append(chirpIds, chirp.Id)
+	}
+	impressions, err := db.GetImpressions(chirpIds)
+	if err != nil {
+		return err
+	}
+
+	polls, err := db.GetPolls()
+	if err != nil {
+		return err
+	}
+
+	snapshot := computeTrending(chirps, impressions, polls, time.Now().UTC(), t.window)
+
+	t.mux.Lock()
+	t.snapshot = snapshot
+	t.mux.Unlock()
+	return nil
+}
+
+// run recomputes the snapshot on every interval until done is closed
+func (t *trendingCache) run(db *database.DB, interval time.Duration, done <-chan struct{}) {
+	if err := t.refresh(db); err != nil {
+		fmt.Println("Unable to compute trending:", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.refresh(db); err != nil {
+				fmt.Println("Unable to compute trending:", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// decay halves a score's weight every half window, so engagement from the
+// start of the window counts for a quarter of engagement happening now
+func decay(age time.Duration, window time.Duration) float64 {
+	if age < 0 {
+		age = 0
+	}
+	halfLife := window.Hours() / 2
+	return math.Pow(0.5, age.Hours()/halfLife)
+}
+
+func computeTrending(chirps []database.Chirp, impressions map[int]map[string]int, polls map[int]database.Poll, now time.Time, window time.Duration) trendingSnapshot {
+	windowStart := now.Add(-window)
+
+	scoredChirps := []trendingChirp{}
+	tagScores := map[string]float64{}
+	for _, chirp := range chirps {
+		score := 0.0
+
+		// impressions are bucketed per day, so age each bucket from its midpoint
+		for date, count := range impressions[chirp.Id] {
+			dayStart, err := time.Parse("2006-01-02", date)
+			if err != nil || !dayStart.Add(24*time.Hour).After(windowStart) {
+				continue
+			}
+			midpoint := dayStart.Add(12 * time.Hour)
+			score += float64(count) * decay(now.Sub(midpoint), window)
+		}
+
+		// votes carry no timestamp, so they decay with the chirp itself
+		createdInWindow := chirp.CreatedAt.After(windowStart)
+		if poll, ok := polls[chirp.Id]; ok && createdInWindow {
+			score += trendingVoteWeight * float64(len(poll.Votes)) * decay(now.Sub(chirp.CreatedAt), window)
+		}
+
+		for _, tag := range extractHashtags(chirp.Body) {
+			tagScores[tag] += score
+			if createdInWindow {
+				tagScores[tag] += trendingHashtagUseWeight * decay(now.Sub(chirp.CreatedAt), window)
+			}
+		}
+
+		if score > 0 {
+			scoredChirps = append(scoredChirps, trendingChirp{Chirp: chirp, Score: score})
+		}
+	}
+
+	hashtags := []trendingHashtag{}
+	for tag, score := range tagScores {
+		if score > 0 {
+			hashtags = append(hashtags, trendingHashtag{Tag: tag, Score: score})
+		}
+	}
+
+	// highest score first, ties broken so the output is stable
+	slices.SortFunc(scoredChirps, func(a, b trendingChirp) int {
+		if c := cmp.Compare(b.Score, a.Score); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.Id, a.Id)
+	})
+	slices.SortFunc(hashtags, func(a, b trendingHashtag) int {
+		if c := cmp.Compare(b.Score, a.Score); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Tag, b.Tag)
+	})
+
+	return trendingSnapshot{
+		Hashtags:   hashtags,
+		Chirps:     scoredChirps,
+		ComputedAt: now,
+	}
+}